@@ -0,0 +1,31 @@
+package alphasoc
+
+// Severity is threat severity level, from 1 (lowest) to 5 (highest).
+type Severity int
+
+// AlertsResponse represents API response with alerts
+type AlertsResponse struct {
+	Follow string `json:"follow"`
+	More   bool   `json:"more"`
+	After  string `json:"after,omitempty"`
+	Before string `json:"before,omitempty"`
+
+	Alerts *[]EventAlert `json:"alerts,omitempty"`
+
+	Threats map[string]ThreatInfo `json:"threats"`
+}
+
+// EventAlert is single event with threats detected in it.
+type EventAlert struct {
+	Type    string                 `json:"eventType"`
+	Event   map[string]interface{} `json:"event"`
+	Threats []string               `json:"threats"`
+	Wisdom  map[string]interface{} `json:"wisdom"`
+}
+
+// ThreatInfo describes threat from the threats catalogue.
+type ThreatInfo struct {
+	Title    string   `json:"title"`
+	Severity Severity `json:"severity"`
+	Policy   bool     `json:"policy,omitempty"`
+}
@@ -0,0 +1,193 @@
+// Package alphasoc provides client for AlphaSOC API.
+package alphasoc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+// AlertsPath is API path of alerts endpoint.
+const AlertsPath = "/v1/alerts"
+
+// Client is AlphaSOC API client.
+type Client struct {
+	url        *url.URL
+	key        string
+	client     *http.Client
+	onResponse func(q Query, body []byte)
+}
+
+// Option configures Client.
+type Option func(*Client)
+
+// WithTransport sets round tripper used to make requests.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Client) {
+		c.client.Transport = rt
+	}
+}
+
+// WithTimeout sets time limit for a request, including reading the response.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.client.Timeout = d
+	}
+}
+
+// WithResponseHook sets function called with raw body of every alerts
+// response accepted by API, before the body is decoded.
+func WithResponseHook(fn func(q Query, body []byte)) Option {
+	return func(c *Client) {
+		c.onResponse = fn
+	}
+}
+
+// New creates client for API available at apiURL, authenticating with key.
+func New(apiURL, key string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing api url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported api url scheme %q", u.Scheme)
+	}
+
+	c := &Client{
+		url:    u,
+		key:    key,
+		client: &http.Client{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// Query selects alerts to fetch. Follow takes precedence over After, Before
+// bounds the alerts either way. Zero values are not sent.
+type Query struct {
+	Follow string
+	After  time.Time
+	Before time.Time
+}
+
+// values returns query parameters of the request.
+func (q Query) values() url.Values {
+	v := url.Values{}
+	if q.Follow != "" {
+		v.Set("follow", q.Follow)
+	} else if !q.After.IsZero() {
+		v.Set("after", q.After.UTC().Format(time.RFC3339))
+	}
+	if !q.Before.IsZero() {
+		v.Set("before", q.Before.UTC().Format(time.RFC3339))
+	}
+	return v
+}
+
+// Alerts fetches alerts newer than follow token. Empty follow fetches
+// alerts from the beginning.
+func (c *Client) Alerts(ctx context.Context, follow string) (*AlertsResponse, error) {
+	return c.Query(ctx, Query{Follow: follow})
+}
+
+// Query fetches alerts selected by q. Transport failures are returned as
+// *url.Error, failures reading or decoding the response body as
+// *ResponseError, API failures as *AuthError, *RateLimitError, *ServerError,
+// *InvalidFollowError or *StatusError.
+func (c *Client) Query(ctx context.Context, q Query) (*AlertsResponse, error) {
+	u := *c.url
+	u.Path = path.Join(u.Path, AlertsPath)
+	u.User = url.User(c.key)
+	u.RawQuery = q.values().Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Encoding", "gzip")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp, q.Follow); err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = resp.Body
+	if c.onResponse != nil {
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, &ResponseError{err}
+		}
+		c.onResponse(q, data)
+		r = bytes.NewReader(data)
+	}
+
+	body := &AlertsResponse{Alerts: &[]EventAlert{}}
+	if err := json.NewDecoder(r).Decode(body); err != nil {
+		return nil, &ResponseError{fmt.Errorf("json.Decode: %w", err)}
+	}
+
+	return body, nil
+}
+
+// checkStatus returns typed error for response with unexpected status code.
+func checkStatus(resp *http.Response, follow string) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	se := StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After")),
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return &AuthError{se}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return &RateLimitError{se}
+	case resp.StatusCode == http.StatusBadRequest && follow != "":
+		// follow is sent alone, or with before bounding a backfill, so the
+		// request is rejected for the token.
+		return &InvalidFollowError{se, follow}
+	case resp.StatusCode >= 500:
+		return &ServerError{se}
+	default:
+		return &se
+	}
+}
+
+// retryAfter parses value of Retry-After header, given either in seconds
+// or as HTTP date. It returns zero for missing or invalid value.
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
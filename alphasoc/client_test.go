@@ -0,0 +1,285 @@
+package alphasoc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const alertsBody = `{
+	"follow": "6-8263d641",
+	"more": true,
+	"alerts": [
+		{
+			"eventType": "dns",
+			"event": {"ts": "2021-04-07T09:55:37Z", "query": "hsxfrfokdkojcj.net"},
+			"threats": ["suspicious_domain_volume"]
+		}
+	],
+	"threats": {
+		"suspicious_domain_volume": {
+			"title": "Multiple requests to suspicious domains",
+			"severity": 3
+		}
+	}
+}`
+
+func newTestClient(t *testing.T, h http.HandlerFunc, opts ...Option) *Client {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	c, err := New(srv.URL+"/api", "test-key", opts...)
+	require.NoError(t, err)
+	return c
+}
+
+func TestClient_Alerts(t *testing.T) {
+	var req *http.Request
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		w.Write([]byte(alertsBody))
+	})
+
+	resp, err := c.Alerts(context.Background(), "5-1e6a8c12")
+	require.NoError(t, err)
+
+	assert.Equal(t, "/api"+AlertsPath, req.URL.Path)
+	assert.Equal(t, "5-1e6a8c12", req.URL.Query().Get("follow"))
+	user, _, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "test-key", user)
+
+	assert.Equal(t, "6-8263d641", resp.Follow)
+	assert.True(t, resp.More)
+	require.Len(t, *resp.Alerts, 1)
+	assert.Equal(t, "dns", (*resp.Alerts)[0].Type)
+	assert.Equal(t, []string{"suspicious_domain_volume"}, (*resp.Alerts)[0].Threats)
+	assert.Equal(t, ThreatInfo{
+		Title:    "Multiple requests to suspicious domains",
+		Severity: 3,
+	}, resp.Threats["suspicious_domain_volume"])
+}
+
+func TestClient_AlertsNoFollow(t *testing.T) {
+	var query url.Values
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(`{"follow": "1-00000000", "alerts": []}`))
+	})
+
+	resp, err := c.Alerts(context.Background(), "")
+	require.NoError(t, err)
+
+	_, ok := query["follow"]
+	assert.False(t, ok)
+	assert.Equal(t, "1-00000000", resp.Follow)
+	assert.Empty(t, *resp.Alerts)
+}
+
+func TestClient_AlertsStatusErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		follow     string
+		check      func(t *testing.T, err error)
+	}{
+		{"unauthorized", http.StatusUnauthorized, "", "", func(t *testing.T, err error) {
+			var e *AuthError
+			require.True(t, errors.As(err, &e))
+			assert.Equal(t, http.StatusUnauthorized, e.StatusCode)
+		}},
+		{"forbidden", http.StatusForbidden, "", "", func(t *testing.T, err error) {
+			var e *AuthError
+			require.True(t, errors.As(err, &e))
+			assert.Equal(t, http.StatusForbidden, e.StatusCode)
+		}},
+		{"rate limit", http.StatusTooManyRequests, "", "", func(t *testing.T, err error) {
+			var e *RateLimitError
+			require.True(t, errors.As(err, &e))
+			assert.Zero(t, e.RetryAfter)
+		}},
+		{"rate limit retry after seconds", http.StatusTooManyRequests, "7", "", func(t *testing.T, err error) {
+			var e *RateLimitError
+			require.True(t, errors.As(err, &e))
+			assert.Equal(t, 7*time.Second, e.RetryAfter)
+		}},
+		{"rate limit retry after date", http.StatusTooManyRequests,
+			time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), "", func(t *testing.T, err error) {
+				var e *RateLimitError
+				require.True(t, errors.As(err, &e))
+				assert.InDelta(t, time.Hour.Seconds(), e.RetryAfter.Seconds(), 5)
+			}},
+		{"server error", http.StatusBadGateway, "", "", func(t *testing.T, err error) {
+			var e *ServerError
+			require.True(t, errors.As(err, &e))
+			assert.Equal(t, http.StatusBadGateway, e.StatusCode)
+		}},
+		{"service unavailable retry after", http.StatusServiceUnavailable, "3", "", func(t *testing.T, err error) {
+			var e *ServerError
+			require.True(t, errors.As(err, &e))
+			assert.Equal(t, 3*time.Second, e.RetryAfter)
+		}},
+		{"bad request", http.StatusBadRequest, "", "", func(t *testing.T, err error) {
+			var e *StatusError
+			require.True(t, errors.As(err, &e))
+			assert.Equal(t, http.StatusBadRequest, e.StatusCode)
+		}},
+		{"invalid follow", http.StatusBadRequest, "", "5-1e6a8c12", func(t *testing.T, err error) {
+			var e *InvalidFollowError
+			require.True(t, errors.As(err, &e))
+			assert.Equal(t, "5-1e6a8c12", e.Follow)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+			})
+
+			resp, err := c.Alerts(context.Background(), tt.follow)
+			assert.Nil(t, resp)
+			require.Error(t, err)
+			tt.check(t, err)
+		})
+	}
+}
+
+func TestClient_AlertsMalformedBody(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"follow": "6-8263d641", "alerts": [`))
+	})
+
+	_, err := c.Alerts(context.Background(), "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "json.Decode")
+
+	var responseErr *ResponseError
+	assert.True(t, errors.As(err, &responseErr))
+}
+
+func TestClient_AlertsTruncatedBody(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		// Connection is closed before the declared length is sent.
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte(`{"follow": "6-8263d641", "alerts": [`))
+	}
+	hook := WithResponseHook(func(Query, []byte) {})
+
+	for name, c := range map[string]*Client{
+		"decode": newTestClient(t, h),
+		"read":   newTestClient(t, h, hook),
+	} {
+		_, err := c.Alerts(context.Background(), "")
+		var responseErr *ResponseError
+		assert.True(t, errors.As(err, &responseErr), "%s: %v", name, err)
+	}
+}
+
+func TestClient_AlertsContextCancel(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-unblock:
+		case <-r.Context().Done():
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := c.Alerts(ctx, "")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	var urlErr *url.Error
+	assert.True(t, errors.As(err, &urlErr))
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestClient_WithTransport(t *testing.T) {
+	called := false
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(alertsBody))
+	}, WithTransport(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		called = true
+		return http.DefaultTransport.RoundTrip(r)
+	})))
+
+	_, err := c.Alerts(context.Background(), "")
+	require.NoError(t, err)
+	assert.True(t, called)
+}
+
+func TestNew_InvalidURL(t *testing.T) {
+	_, err := New("ftp://api.alphasoc.net", "key")
+	assert.Error(t, err)
+
+	_, err = New("://", "key")
+	assert.Error(t, err)
+}
+
+func TestClient_Query(t *testing.T) {
+	var query url.Values
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(alertsBody))
+	})
+
+	after := time.Date(2021, time.April, 7, 9, 55, 37, 0, time.UTC)
+	before := after.Add(time.Hour)
+
+	_, err := c.Query(context.Background(), Query{After: after, Before: before})
+	require.NoError(t, err)
+	assert.Equal(t, url.Values{
+		"after":  {"2021-04-07T09:55:37Z"},
+		"before": {"2021-04-07T10:55:37Z"},
+	}, query)
+
+	_, err = c.Query(context.Background(), Query{Follow: "6-8263d641", After: after})
+	require.NoError(t, err)
+	assert.Equal(t, url.Values{"follow": {"6-8263d641"}}, query)
+
+	_, err = c.Query(context.Background(), Query{Follow: "6-8263d641", After: after, Before: before})
+	require.NoError(t, err)
+	assert.Equal(t, url.Values{
+		"follow": {"6-8263d641"},
+		"before": {"2021-04-07T10:55:37Z"},
+	}, query)
+}
+
+func TestClient_WithResponseHook(t *testing.T) {
+	var (
+		query Query
+		raw   []byte
+	)
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(alertsBody))
+	}, WithResponseHook(func(q Query, body []byte) {
+		query, raw = q, body
+	}))
+
+	resp, err := c.Alerts(context.Background(), "5-1e6a8c12")
+	require.NoError(t, err)
+	assert.Equal(t, "6-8263d641", resp.Follow)
+	assert.Equal(t, "5-1e6a8c12", query.Follow)
+	assert.Equal(t, alertsBody, string(raw))
+}
@@ -0,0 +1,72 @@
+package alphasoc
+
+import (
+	"fmt"
+	"time"
+)
+
+// StatusError is returned when API responds with unexpected status code.
+// RetryAfter is set if API specified when to retry the request.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response status: %s", e.Status)
+}
+
+// AuthError is returned when API rejects the api key.
+type AuthError struct {
+	StatusError
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("api key rejected: %s", e.Status)
+}
+
+// RateLimitError is returned when API limits the number of requests.
+type RateLimitError struct {
+	StatusError
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited: %s, retry after %v", e.Status, e.RetryAfter)
+	}
+	return fmt.Sprintf("rate limited: %s", e.Status)
+}
+
+// ServerError is returned when API fails with 5xx status code.
+type ServerError struct {
+	StatusError
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error: %s", e.Status)
+}
+
+// InvalidFollowError is returned when API rejects the follow token.
+type InvalidFollowError struct {
+	StatusError
+	Follow string
+}
+
+func (e *InvalidFollowError) Error() string {
+	return fmt.Sprintf("follow token %q rejected: %s", e.Follow, e.Status)
+}
+
+// ResponseError is returned when body of the alerts response cannot be read
+// or decoded, e.g. when the connection breaks or times out while reading it.
+type ResponseError struct {
+	Err error
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("invalid alerts response: %v", e.Err)
+}
+
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
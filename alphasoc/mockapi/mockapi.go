@@ -0,0 +1,255 @@
+// Package mockapi provides a local stand-in for the AlphaSOC alerts API
+// serving scripted responses, for development and tests.
+package mockapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc"
+)
+
+// Response is a scripted response of the alerts endpoint. Body, if set, is
+// served as is instead of Page, e.g. to serve malformed JSON. Disconnect
+// closes the connection without response and Hang holds the request until
+// the client gives up.
+type Response struct {
+	Status     int                      `json:"status,omitempty"` // HTTP status code, 200 if zero.
+	Header     map[string]string        `json:"header,omitempty"`
+	Page       *alphasoc.AlertsResponse `json:"page,omitempty"`
+	Body       string                   `json:"body,omitempty"`
+	Disconnect bool                     `json:"disconnect,omitempty"`
+	Hang       bool                     `json:"hang,omitempty"`
+}
+
+// Page returns response with the page of alerts.
+func Page(follow string, more bool, alerts ...alphasoc.EventAlert) Response {
+	if alerts == nil {
+		alerts = []alphasoc.EventAlert{}
+	}
+	return Response{Page: &alphasoc.AlertsResponse{
+		Follow:  follow,
+		More:    more,
+		Alerts:  &alerts,
+		Threats: threats(alerts),
+	}}
+}
+
+// RateLimited returns 429 response asking to retry after d, given in whole
+// seconds. Zero d omits Retry-After header.
+func RateLimited(d time.Duration) Response {
+	r := Response{Status: http.StatusTooManyRequests}
+	if d > 0 {
+		r.Header = map[string]string{"Retry-After": strconv.Itoa(int(d.Seconds()))}
+	}
+	return r
+}
+
+// ServerError returns response with the 5xx status code.
+func ServerError(code int) Response {
+	return Response{Status: code}
+}
+
+// ClientError returns response with the 4xx status code.
+func ClientError(code int) Response {
+	return Response{Status: code}
+}
+
+// Disconnected returns response failing the request on the network level.
+func Disconnected() Response {
+	return Response{Disconnect: true}
+}
+
+// Hanging returns response never answering the request.
+func Hanging() Response {
+	return Response{Hang: true}
+}
+
+// InvalidFollow returns response rejecting the follow token.
+func InvalidFollow() Response {
+	return Response{Status: http.StatusBadRequest, Body: `{"message": "invalid follow"}`}
+}
+
+// Malformed returns response with a truncated JSON body.
+func Malformed() Response {
+	return Response{Body: `{"follow": "1-trunc", "alerts": [{"eventType": "dns", "ev`}
+}
+
+// Alert returns DNS alert of the given threat detected at ts.
+func Alert(ts time.Time, query, threat string) alphasoc.EventAlert {
+	return alphasoc.EventAlert{
+		Type: "dns",
+		Event: map[string]interface{}{
+			"ts":       ts.UTC().Format(time.RFC3339),
+			"srcIP":    "10.0.0.1",
+			"query":    query,
+			"qtype":    "A",
+			"srcHost":  "workstation-1",
+			"protocol": "udp",
+		},
+		Threats: []string{threat},
+		Wisdom:  map[string]interface{}{"flags": []string{"young_domain"}},
+	}
+}
+
+// Generate returns script of pages with size alerts each, alerts of the
+// last page are not followed by more.
+func Generate(pages, size int) []Response {
+	start := time.Now().Add(-time.Duration(pages*size) * time.Minute).Truncate(time.Minute)
+
+	script := make([]Response, 0, pages)
+	for p := 1; p <= pages; p++ {
+		alerts := make([]alphasoc.EventAlert, 0, size)
+		for i := 0; i < size; i++ {
+			n := (p-1)*size + i
+			alerts = append(alerts, Alert(start.Add(time.Duration(n)*time.Minute),
+				fmt.Sprintf("mock-%d.example.net", n), "suspicious_domain_volume"))
+		}
+		script = append(script, Page(fmt.Sprintf("%d-mock", p), p < pages, alerts...))
+	}
+	return script
+}
+
+// LoadScript reads script given as JSON array of responses.
+func LoadScript(r io.Reader) ([]Response, error) {
+	var script []Response
+	if err := json.NewDecoder(r).Decode(&script); err != nil {
+		return nil, fmt.Errorf("parsing script: %w", err)
+	}
+	return script, nil
+}
+
+// knownThreats describes threats used by Alert.
+var knownThreats = map[string]alphasoc.ThreatInfo{
+	"suspicious_domain_volume": {Title: "Multiple requests to suspicious domains", Severity: 3},
+	"c2_communication":         {Title: "C2 communication attempt indicating infection", Severity: 5},
+}
+
+// threats returns catalogue of the threats detected in alerts.
+func threats(alerts []alphasoc.EventAlert) map[string]alphasoc.ThreatInfo {
+	m := map[string]alphasoc.ThreatInfo{}
+	for _, a := range alerts {
+		for _, t := range a.Threats {
+			if info, ok := knownThreats[t]; ok {
+				m[t] = info
+			}
+		}
+	}
+	return m
+}
+
+// Request is a request received by the server.
+type Request struct {
+	Time   time.Time
+	Key    string
+	Follow string
+	After  string
+	Before string
+}
+
+// Server serves scripted responses of the alerts endpoint, one per request.
+// When the script is exhausted it serves empty pages keeping the follow
+// token. Requests with other api key than Key, if set, are rejected.
+type Server struct {
+	Key string
+
+	mu       sync.Mutex
+	script   []Response
+	requests []Request
+}
+
+// New returns server serving the script.
+func New(script ...Response) *Server {
+	return &Server{script: script}
+}
+
+// Append adds responses to the end of the script.
+func (s *Server) Append(script ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.script = append(s.script, script...)
+}
+
+// Pending returns number of scripted responses not served yet.
+func (s *Server) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.script)
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// ServeHTTP serves the next scripted response.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != alphasoc.AlertsPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	key, _, _ := r.BasicAuth()
+	q := r.URL.Query()
+	req := Request{
+		Time:   time.Now(),
+		Key:    key,
+		Follow: q.Get("follow"),
+		After:  q.Get("after"),
+		Before: q.Get("before"),
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	if s.Key != "" && key != s.Key {
+		s.mu.Unlock()
+		http.Error(w, `{"message": "invalid api key"}`, http.StatusUnauthorized)
+		return
+	}
+	resp := Page(req.Follow, false)
+	if len(s.script) > 0 {
+		resp, s.script = s.script[0], s.script[1:]
+	}
+	s.mu.Unlock()
+
+	resp.write(w, r)
+}
+
+// write writes the response to the request.
+func (r Response) write(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case r.Disconnect:
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conn.Close()
+		}
+		return
+	case r.Hang:
+		<-req.Context().Done()
+		return
+	}
+
+	for k, v := range r.Header {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Status != 0 {
+		w.WriteHeader(r.Status)
+	}
+
+	switch {
+	case r.Body != "":
+		io.WriteString(w, r.Body)
+	case r.Page != nil:
+		json.NewEncoder(w).Encode(r.Page)
+	}
+}
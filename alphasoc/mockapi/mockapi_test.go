@@ -0,0 +1,140 @@
+package mockapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc"
+)
+
+func newTestClient(t *testing.T, s *Server, key string) *alphasoc.Client {
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	c, err := alphasoc.New(srv.URL, key)
+	require.NoError(t, err)
+	return c
+}
+
+func TestServer(t *testing.T) {
+	ts := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	s := New(
+		Page("1-a", true, Alert(ts, "a.example.net", "c2_communication")),
+		RateLimited(2*time.Second),
+		ServerError(http.StatusServiceUnavailable),
+		InvalidFollow(),
+		Malformed(),
+		Page("2-b", false),
+	)
+	c := newTestClient(t, s, "test-key")
+	ctx := context.Background()
+
+	resp, err := c.Alerts(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, "1-a", resp.Follow)
+	assert.True(t, resp.More)
+	require.Len(t, *resp.Alerts, 1)
+	assert.Equal(t, "a.example.net", (*resp.Alerts)[0].Event["query"])
+	assert.Equal(t, alphasoc.Severity(5), resp.Threats["c2_communication"].Severity)
+
+	_, err = c.Alerts(ctx, "1-a")
+	var rateLimitErr *alphasoc.RateLimitError
+	require.True(t, errors.As(err, &rateLimitErr), "unexpected error: %v", err)
+	assert.Equal(t, 2*time.Second, rateLimitErr.RetryAfter)
+
+	_, err = c.Alerts(ctx, "1-a")
+	var serverErr *alphasoc.ServerError
+	assert.True(t, errors.As(err, &serverErr), "unexpected error: %v", err)
+
+	_, err = c.Alerts(ctx, "1-a")
+	var invalidFollowErr *alphasoc.InvalidFollowError
+	assert.True(t, errors.As(err, &invalidFollowErr), "unexpected error: %v", err)
+
+	_, err = c.Alerts(ctx, "1-a")
+	assert.Error(t, err)
+
+	resp, err = c.Alerts(ctx, "1-a")
+	require.NoError(t, err)
+	assert.Equal(t, "2-b", resp.Follow)
+	assert.False(t, resp.More)
+	assert.Empty(t, *resp.Alerts)
+
+	// Exhausted script keeps the follow token.
+	assert.Equal(t, 0, s.Pending())
+	resp, err = c.Alerts(ctx, "2-b")
+	require.NoError(t, err)
+	assert.Equal(t, "2-b", resp.Follow)
+
+	requests := s.Requests()
+	require.Len(t, requests, 7)
+	assert.Equal(t, "", requests[0].Follow)
+	assert.Equal(t, "1-a", requests[1].Follow)
+	assert.Equal(t, "test-key", requests[1].Key)
+}
+
+func TestServer_Key(t *testing.T) {
+	s := New(Page("1-a", false))
+	s.Key = "test-key"
+
+	_, err := newTestClient(t, s, "other-key").Alerts(context.Background(), "")
+	var authErr *alphasoc.AuthError
+	assert.True(t, errors.As(err, &authErr), "unexpected error: %v", err)
+	assert.Equal(t, 1, s.Pending())
+
+	resp, err := newTestClient(t, s, "test-key").Alerts(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, "1-a", resp.Follow)
+}
+
+func TestServer_Failures(t *testing.T) {
+	s := New(Disconnected(), ClientError(http.StatusNotFound), Hanging())
+	c := newTestClient(t, s, "test-key")
+
+	_, err := c.Alerts(context.Background(), "")
+	assert.Error(t, err)
+
+	_, err = c.Alerts(context.Background(), "")
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.Alerts(ctx, "")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+	assert.Len(t, s.Requests(), 3)
+}
+
+func TestGenerate(t *testing.T) {
+	script := Generate(3, 2)
+	require.Len(t, script, 3)
+	for i, r := range script {
+		assert.Len(t, *r.Page.Alerts, 2)
+		assert.Equal(t, i < 2, r.Page.More)
+	}
+	assert.Equal(t, "3-mock", script[2].Page.Follow)
+}
+
+func TestLoadScript(t *testing.T) {
+	script, err := LoadScript(strings.NewReader(`[
+		{"page": {"follow": "1-a", "more": true, "alerts": []}},
+		{"status": 429, "header": {"Retry-After": "1"}},
+		{"body": "{not json"},
+		{"disconnect": true}
+	]`))
+	require.NoError(t, err)
+	require.Len(t, script, 4)
+	assert.Equal(t, "1-a", script[0].Page.Follow)
+	assert.Equal(t, 429, script[1].Status)
+	assert.Equal(t, "{not json", script[2].Body)
+	assert.True(t, script[3].Disconnect)
+
+	_, err = LoadScript(strings.NewReader(`{"page": {}}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,109 @@
+package beater
+
+import (
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common/acker"
+
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+)
+
+// page is a single alerts response that has been handed to the publisher.
+type page struct {
+	state   checkpoint.State
+	pending int
+}
+
+// pageTracker keeps track of published pages and passes the state of a page
+// to persist only after all of its events, and all events of the pages
+// published before it, have been acknowledged by the output.
+type pageTracker struct {
+	mu      sync.Mutex
+	pages   []*page
+	persist func(s checkpoint.State)
+
+	// drained is closed while no pages wait for acknowledgement.
+	drained chan struct{}
+}
+
+func newPageTracker(persist func(s checkpoint.State)) *pageTracker {
+	drained := make(chan struct{})
+	close(drained)
+	return &pageTracker{persist: persist, drained: drained}
+}
+
+// acker returns the ACK handler to be used when connecting to the pipeline.
+func (t *pageTracker) acker() beat.ACKer {
+	return acker.ConnectionOnly(
+		acker.EventPrivateReporter(func(_ int, data []interface{}) {
+			t.ack(data)
+		}),
+	)
+}
+
+// add registers events as a page with the stream state after the page.
+// It must be called before the events are published.
+func (t *pageTracker) add(s checkpoint.State, events []beat.Event) {
+	p := &page{state: s, pending: len(events)}
+	for i := range events {
+		events[i].Private = p
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.pages) == 0 {
+		t.drained = make(chan struct{})
+	}
+	t.pages = append(t.pages, p)
+	t.commit()
+}
+
+// ack marks events as acknowledged, data holds their private fields.
+func (t *pageTracker) ack(data []interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, d := range data {
+		if p, ok := d.(*page); ok && p.pending > 0 {
+			p.pending--
+		}
+	}
+	t.commit()
+}
+
+// pending returns the number of pages waiting for acknowledgement.
+func (t *pageTracker) pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.pages)
+}
+
+// idle returns channel closed when no pages wait for acknowledgement. Pages
+// added later are not waited for.
+func (t *pageTracker) idle() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.drained
+}
+
+// commit persists the state of the newest page for which it and all
+// the pages before it have been fully acknowledged.
+func (t *pageTracker) commit() {
+	var last *page
+	for len(t.pages) > 0 && t.pages[0].pending == 0 {
+		last = t.pages[0]
+		t.pages[0] = nil
+		t.pages = t.pages[1:]
+	}
+
+	if last != nil {
+		t.persist(last.state)
+		if len(t.pages) == 0 {
+			close(t.drained)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package beater
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+)
+
+// fakeClient is a publisher client forwarding events to an ACKer the way
+// the libbeat pipeline does. Events matching drop are reported as dropped
+// by processors, the rest is acknowledged by the test, or right away
+// if autoACK is set, or when the client is closed if ackOnClose is set.
+type fakeClient struct {
+	mu         sync.Mutex
+	acker      beat.ACKer
+	drop       func(beat.Event) bool
+	autoACK    bool
+	ackOnClose bool
+	published  []beat.Event
+	unacked    int
+	closed     bool
+}
+
+func (c *fakeClient) Publish(e beat.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.drop != nil && c.drop(e) {
+		c.acker.AddEvent(e, false)
+		return
+	}
+	c.acker.AddEvent(e, true)
+	c.published = append(c.published, e)
+	if c.autoACK {
+		c.acker.ACKEvents(1)
+	} else {
+		c.unacked++
+	}
+}
+
+func (c *fakeClient) PublishAll(events []beat.Event) {
+	for _, e := range events {
+		c.Publish(e)
+	}
+}
+
+func (c *fakeClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ackOnClose && c.unacked > 0 {
+		c.acker.ACKEvents(c.unacked)
+		c.unacked = 0
+	}
+	c.acker.Close()
+	c.closed = true
+	return nil
+}
+
+// ackInOrder acknowledges the n oldest not acknowledged events.
+func (c *fakeClient) ackInOrder(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.acker.ACKEvents(n)
+	c.unacked -= n
+}
+
+func (c *fakeClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+// events returns all the events published so far.
+func (c *fakeClient) events() []beat.Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]beat.Event(nil), c.published...)
+}
+
+func testEvents(n int) []beat.Event {
+	return make([]beat.Event, n)
+}
+
+func TestPageTracker_PersistsAfterACK(t *testing.T) {
+	var persisted []string
+	tracker := newPageTracker(func(s checkpoint.State) { persisted = append(persisted, s.Follow) })
+	client := &fakeClient{acker: tracker.acker()}
+
+	events := testEvents(3)
+	tracker.add(checkpoint.State{Follow: "1"}, events)
+	client.PublishAll(events)
+
+	// Output delays acknowledgement, nothing may be persisted yet.
+	assert.Empty(t, persisted)
+
+	client.ackInOrder(2)
+	assert.Empty(t, persisted)
+
+	client.ackInOrder(1)
+	assert.Equal(t, []string{"1"}, persisted)
+	assert.Equal(t, 0, tracker.pending())
+}
+
+func TestPageTracker_MultiplePages(t *testing.T) {
+	var persisted []string
+	tracker := newPageTracker(func(s checkpoint.State) { persisted = append(persisted, s.Follow) })
+	client := &fakeClient{acker: tracker.acker()}
+
+	for _, follow := range []string{"1", "2", "3"} {
+		events := testEvents(2)
+		tracker.add(checkpoint.State{Follow: follow}, events)
+		client.PublishAll(events)
+	}
+
+	// Single ACK covering the first two pages persists only the latest one.
+	client.ackInOrder(4)
+	assert.Equal(t, []string{"2"}, persisted)
+
+	client.ackInOrder(2)
+	assert.Equal(t, []string{"2", "3"}, persisted)
+}
+
+func TestPageTracker_EmptyPage(t *testing.T) {
+	var persisted []string
+	tracker := newPageTracker(func(s checkpoint.State) { persisted = append(persisted, s.Follow) })
+	client := &fakeClient{acker: tracker.acker()}
+
+	// Empty page with nothing in flight is persisted right away.
+	tracker.add(checkpoint.State{Follow: "1"}, nil)
+	assert.Equal(t, []string{"1"}, persisted)
+
+	events := testEvents(1)
+	tracker.add(checkpoint.State{Follow: "2"}, events)
+	client.PublishAll(events)
+
+	// Empty page must wait for the pages before it.
+	tracker.add(checkpoint.State{Follow: "3"}, nil)
+	assert.Equal(t, []string{"1"}, persisted)
+
+	client.ackInOrder(1)
+	assert.Equal(t, []string{"1", "3"}, persisted)
+}
+
+func TestPageTracker_DroppedEvents(t *testing.T) {
+	var persisted []string
+	tracker := newPageTracker(func(s checkpoint.State) { persisted = append(persisted, s.Follow) })
+	client := &fakeClient{
+		acker: tracker.acker(),
+		drop: func(e beat.Event) bool {
+			_, ok := e.Fields["drop"]
+			return ok
+		},
+	}
+
+	events := []beat.Event{
+		{Fields: map[string]interface{}{}},
+		{Fields: map[string]interface{}{"drop": true}},
+		{Fields: map[string]interface{}{"drop": true}},
+	}
+	tracker.add(checkpoint.State{Follow: "1"}, events)
+	client.PublishAll(events)
+	assert.Empty(t, persisted)
+
+	// Dropped events are reported together with the published event
+	// preceding them.
+	client.ackInOrder(1)
+	assert.Equal(t, []string{"1"}, persisted)
+
+	// Page with all events dropped is persisted without any output ACK.
+	events = []beat.Event{
+		{Fields: map[string]interface{}{"drop": true}},
+	}
+	tracker.add(checkpoint.State{Follow: "2"}, events)
+	client.PublishAll(events)
+	assert.Equal(t, []string{"1", "2"}, persisted)
+}
+
+func TestPageTracker_OutOfOrderACK(t *testing.T) {
+	var persisted []string
+	tracker := newPageTracker(func(s checkpoint.State) { persisted = append(persisted, s.Follow) })
+
+	first, second, third := testEvents(2), testEvents(1), testEvents(2)
+	tracker.add(checkpoint.State{Follow: "1"}, first)
+	tracker.add(checkpoint.State{Follow: "2"}, second)
+	tracker.add(checkpoint.State{Follow: "3"}, third)
+
+	// Later pages are complete, but the first one is not.
+	tracker.ack([]interface{}{third[1].Private, second[0].Private, third[0].Private})
+	assert.Empty(t, persisted)
+
+	tracker.ack([]interface{}{first[1].Private})
+	assert.Empty(t, persisted)
+
+	tracker.ack([]interface{}{first[0].Private})
+	assert.Equal(t, []string{"3"}, persisted)
+	assert.Equal(t, 0, tracker.pending())
+}
+
+func TestPageTracker_NoACKAfterClose(t *testing.T) {
+	var persisted []string
+	tracker := newPageTracker(func(s checkpoint.State) { persisted = append(persisted, s.Follow) })
+	client := &fakeClient{acker: tracker.acker()}
+
+	events := testEvents(1)
+	tracker.add(checkpoint.State{Follow: "1"}, events)
+	client.PublishAll(events)
+	client.Close()
+
+	client.ackInOrder(1)
+	assert.Empty(t, persisted)
+	assert.Equal(t, 1, tracker.pending())
+}
+
+func TestPageTracker_Idle(t *testing.T) {
+	tracker := newPageTracker(func(checkpoint.State) {})
+	client := &fakeClient{acker: tracker.acker()}
+
+	isClosed := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+	assert.True(t, isClosed(tracker.idle()))
+
+	tracker.add(checkpoint.State{Follow: "1"}, nil)
+	assert.True(t, isClosed(tracker.idle()))
+
+	events := testEvents(2)
+	tracker.add(checkpoint.State{Follow: "2"}, events)
+	client.PublishAll(events)
+	idle := tracker.idle()
+	assert.False(t, isClosed(idle))
+
+	client.ackInOrder(1)
+	assert.False(t, isClosed(idle))
+	client.ackInOrder(1)
+	assert.True(t, isClosed(idle))
+	assert.True(t, isClosed(tracker.idle()))
+}
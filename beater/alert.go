@@ -1,96 +1,183 @@
 package beater
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"time"
 
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/common"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc"
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+// Alert types are defined by the API client.
+type (
+	alertResponse = alphasoc.AlertsResponse
+	eventAlert    = alphasoc.EventAlert
+	severity      = alphasoc.Severity
+	threatInfo    = alphasoc.ThreatInfo
 )
 
-type severity int
+// converter converts alerts to beat events.
+type converter struct {
+	// fingerprintFields holds event fields used to compute document ID per pipeline.
+	fingerprintFields map[string][]string
+
+	// tenant is name of the input, it is part of the document ID, so equal
+	// alerts of different accounts are kept apart.
+	tenant string
+
+	// ecs selects mapping_version 2, which maps protocol data to ECS fields.
+	ecs bool
+
+	// mappings override per pipeline the fields attributes are mapped to.
+	mappings map[string]config.MappingConfig
 
-// alertResponse represents API response with alerts
-type alertResponse struct {
-	Follow string `json:"follow"`
-	More   bool   `json:"more"`
-	After  string `json:"after,omitempty"`
-	Before string `json:"before,omitempty"`
+	// preserve keeps attributes without mapping under the extra fields
+	// and the alert in event.original.
+	preserve bool
+}
 
-	Alerts *[]eventAlert `json:"alerts,omitempty"`
+// newConverter creates converter with fingerprint fields overridden
+// by the given per pipeline settings.
+func newConverter(fingerprint map[string][]string) *converter {
+	c := &converter{fingerprintFields: map[string][]string{}}
+	for pipeline, fields := range fingerprintFields {
+		c.fingerprintFields[pipeline] = fields
+	}
+	for pipeline, fields := range fingerprint {
+		c.fingerprintFields[pipeline] = fields
+	}
+	return c
+}
 
-	Threats map[string]threatInfo `json:"threats"`
+// configure applies the mapping settings of c.
+func (c *converter) configure(cfg config.Config) {
+	c.ecs = cfg.MappingVersion == config.MappingVersionECS
+	c.mappings = cfg.Mappings
+	c.preserve = cfg.PreserveUnmapped
 }
 
-type eventAlert struct {
-	Type    string                 `json:"eventType"`
-	Event   map[string]interface{} `json:"event"`
-	Threats []string               `json:"threats"`
-	Wisdom  map[string]interface{} `json:"wisdom"`
+// fingerprint returns stable ID of the alert and threat pair. The ID
+// does not depend on the order of event fields.
+func (c *converter) fingerprint(a *eventAlert, threat string) string {
+	fields, ok := c.fingerprintFields[a.Type]
+	if !ok {
+		fields = defaultFingerprintFields
+	}
+
+	event := make(map[string]interface{}, len(fields))
+	for _, k := range fields {
+		if v, ok := a.Event[k]; ok {
+			event[k] = v
+		}
+	}
+
+	id := map[string]interface{}{
+		"eventType": a.Type,
+		"event":     event,
+		"threat":    threat,
+	}
+	if c.tenant != "" {
+		id["tenant"] = c.tenant
+	}
+
+	// json.Marshal sorts map keys, which makes the input deterministic.
+	data, _ := json.Marshal(id)
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
-type threatInfo struct {
-	Title    string   `json:"title"`
-	Severity severity `json:"severity"`
-	Policy   bool     `json:"policy,omitempty"`
+// alertTime returns event timestamp of the alert.
+func alertTime(a *eventAlert) (time.Time, bool) {
+	s, ok := a.Event["ts"].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// lastAlertTime returns the newest event timestamp of alerts in the
+// response, or zero time if there is none.
+func lastAlertTime(ar *alertResponse) time.Time {
+	var last time.Time
+	if ar.Alerts == nil {
+		return last
+	}
+
+	for i := range *ar.Alerts {
+		if t, ok := alertTime(&(*ar.Alerts)[i]); ok && t.After(last) {
+			last = t
+		}
+	}
+	return last
 }
 
 // beatEvents converts alerts from alertResponse to beat events
 // with proper index fields mapping
-func (ar *alertResponse) beatEvents() []beat.Event {
+func (c *converter) beatEvents(ar *alertResponse) []beat.Event {
 	events := []beat.Event{}
+	if ar.Alerts == nil {
+		return events
+	}
+
+	for i := range *ar.Alerts {
+		a := &(*ar.Alerts)[i]
+
+		mapped := c.alertFields(a)
+		eventExtra, wisdomExtra := c.unmapped(a)
+		var original string
+		if c.preserve {
+			data, _ := json.Marshal(a)
+			original = string(data)
+		}
 
-	for _, a := range *ar.Alerts {
 		// Create separate document for each threat
 		for _, threat := range a.Threats {
 			// Parse event timestamp
-			ts := time.Now()
-			t, ok := a.Event["ts"]
-			if ok {
-				parsed, err := time.Parse(time.RFC3339, t.(string))
-				if err == nil {
-					ts = parsed
-				}
+			ts, ok := alertTime(a)
+			if !ok {
+				ts = time.Now()
 			}
 
 			beatEvent := beat.Event{
 				Timestamp: ts,
 				Fields: common.MapStr{
-					"alphasoc.event.ts": ts.Format("2006-01-02 15:04:05"),
+					"alphasoc.event.ts": ts.UTC(),
 					"alphasoc.pipeline": a.Type,
 				},
 			}
+			for k, v := range mapped {
+				beatEvent.Fields[k] = v
+			}
 
-			// Add known event fields values
-			for k, v := range a.Event {
-				if v == "" {
-					continue
+			if c.preserve {
+				if len(eventExtra) > 0 {
+					beatEvent.Fields["alphasoc.event.extra"] = eventExtra.Clone()
 				}
-
-				if mappedKey, ok := eventFields[k]; ok {
-					beatEvent.Fields[mappedKey] = v
-
-					if k == "destIP" && a.Type == "ip" {
-						beatEvent.Fields["alphasoc.event.dest.ip_raw"] = v
-					}
-
-					if k == "url" && a.Type == "http" {
-						beatEvent.Fields["alphasoc.event.dest.url_raw"] = v
-					}
+				if len(wisdomExtra) > 0 {
+					beatEvent.Fields["alphasoc.wisdom.extra"] = wisdomExtra.Clone()
 				}
+				beatEvent.Fields["event.original"] = original
 			}
 
-			// Add known wisdom fields values
-			for k, v := range a.Wisdom {
-				if mappedKey, ok := wisdomFields[k]; ok {
-					beatEvent.Fields[mappedKey] = v
-				}
-			}
+			beatEvent.SetID(c.fingerprint(a, threat))
 
 			beatEvent.Fields["alphasoc.threat.value"] = threat
 			if t, ok := ar.Threats[threat]; ok {
 				beatEvent.Fields["alphasoc.threat.severity"] = t.Severity
 				beatEvent.Fields["alphasoc.threat.title"] = t.Title
 			}
+			addECSAlertFields(beatEvent.Fields, a.Type, threat, ar.Threats)
 
 			events = append(events, beatEvent)
 		}
@@ -98,3 +185,177 @@ func (ar *alertResponse) beatEvents() []beat.Event {
 
 	return events
 }
+
+// alertFields returns fields the event and wisdom attributes of the alert
+// are mapped to, with values normalised to the types of the fields.
+func (c *converter) alertFields(a *eventAlert) common.MapStr {
+	fields := common.MapStr{}
+
+	// Add known event fields values
+	for k, v := range a.Event {
+		if v == "" {
+			continue
+		}
+
+		mappedKey, ok := c.eventField(a.Type, k)
+		if !ok {
+			continue
+		}
+		if nv, ok := coercion.value(a.Type, mappedKey, v); ok {
+			fields[mappedKey] = nv
+		}
+		if c.ecs {
+			continue
+		}
+
+		// Raw copies are keywords, they keep the values as received.
+		if k == "destIP" && a.Type == "ip" {
+			fields["alphasoc.event.dest.ip_raw"] = v
+		}
+
+		if k == "url" && a.Type == "http" {
+			fields["alphasoc.event.dest.url_raw"] = v
+		}
+	}
+	if c.ecs {
+		addDestination(fields, a)
+	}
+
+	// Add known wisdom fields values
+	for k, v := range a.Wisdom {
+		if mappedKey, ok := c.wisdomField(a.Type, k); ok {
+			if nv, ok := coercion.value(a.Type, mappedKey, v); ok {
+				fields[mappedKey] = nv
+			}
+		}
+	}
+	return fields
+}
+
+// eventField returns name of the field the json event field of the pipeline
+// is mapped to.
+func (c *converter) eventField(pipeline, k string) (string, bool) {
+	if mappedKey, ok := c.mappings[pipeline].Event[k]; ok {
+		return mappedKey, mappedKey != ""
+	}
+	if c.ecs {
+		if mappedKey, ok := ecsEventFields[k]; ok {
+			return mappedKey, true
+		}
+	}
+	mappedKey, ok := eventFields[k]
+	return mappedKey, ok
+}
+
+// unmapped returns event and wisdom attributes of the alert without mapping,
+// which are counted and logged.
+func (c *converter) unmapped(a *eventAlert) (event, wisdom common.MapStr) {
+	var eventKeys, wisdomKeys []string
+	for k, v := range a.Event {
+		// Empty values are left out like by alertFields.
+		if k == "ts" || v == "" {
+			continue
+		}
+		if _, ok := c.mappings[a.Type].Event[k]; ok {
+			continue
+		}
+		if _, ok := eventFields[k]; ok {
+			continue
+		}
+		if c.ecs {
+			if _, ok := ecsEventFields[k]; ok {
+				continue
+			}
+		}
+		eventKeys = append(eventKeys, k)
+		if event == nil {
+			event = common.MapStr{}
+		}
+		event[k] = v
+	}
+	for k, v := range a.Wisdom {
+		if _, ok := c.mappings[a.Type].Wisdom[k]; ok {
+			continue
+		}
+		if _, ok := wisdomFields[k]; ok {
+			continue
+		}
+		wisdomKeys = append(wisdomKeys, k)
+		if wisdom == nil {
+			wisdom = common.MapStr{}
+		}
+		wisdom[k] = v
+	}
+
+	unmapped.add(a.Type, "event", eventKeys, c.preserve)
+	unmapped.add(a.Type, "wisdom", wisdomKeys, c.preserve)
+	return event, wisdom
+}
+
+// wisdomField returns name of the field the json wisdom field of the
+// pipeline is mapped to.
+func (c *converter) wisdomField(pipeline, k string) (string, bool) {
+	if mappedKey, ok := c.mappings[pipeline].Wisdom[k]; ok {
+		return mappedKey, mappedKey != ""
+	}
+	mappedKey, ok := wisdomFields[k]
+	return mappedKey, ok
+}
+
+// addDestination sets alphasoc.destination to the event fields copied to it
+// by the index template with mapping_version 1, where the fields copied are
+// aliases with mapping_version 2.
+func addDestination(fields common.MapStr, a *eventAlert) {
+	keys, ok := destinationFields[a.Type]
+	if !ok {
+		keys = defaultDestinationFields
+	}
+
+	var dest []interface{}
+	for _, k := range keys {
+		if v, ok := a.Event[k]; ok && v != "" {
+			dest = append(dest, v)
+		}
+	}
+	switch len(dest) {
+	case 0:
+	case 1:
+		fields["alphasoc.destination"] = dest[0]
+	default:
+		fields["alphasoc.destination"] = dest
+	}
+}
+
+// addECSAlertFields adds ECS fields describing the alert of the pipeline
+// for the threat, so it is recognized as alert by ECS based detection content.
+func addECSAlertFields(fields common.MapStr, pipeline, threat string, catalogue map[string]threatInfo) {
+	cat, ok := eventCategories[pipeline]
+	if !ok {
+		cat = defaultEventCategory
+	}
+	fields["event.kind"] = "alert"
+	// Slices are copied, so processors modifying an event do not change
+	// the categorization of other events.
+	fields["event.category"] = append([]string(nil), cat.category...)
+	fields["event.type"] = append([]string(nil), cat.types...)
+
+	fields["rule.id"] = threat
+	if t, ok := catalogue[threat]; ok {
+		fields["rule.name"] = t.Title
+		fields["rule.category"] = "threat"
+		if t.Policy {
+			fields["rule.category"] = "policy"
+		}
+		fields["event.severity"] = t.Severity
+	}
+
+	if tech, ok := threatTechniques[threat]; ok {
+		fields["threat.framework"] = "MITRE ATT&CK"
+		fields["threat.tactic.id"] = tech.tacticID
+		fields["threat.tactic.name"] = tech.tacticName
+		fields["threat.tactic.reference"] = "https://attack.mitre.org/tactics/" + tech.tacticID + "/"
+		fields["threat.technique.id"] = tech.techniqueID
+		fields["threat.technique.name"] = tech.techniqueName
+		fields["threat.technique.reference"] = "https://attack.mitre.org/techniques/" + tech.techniqueID + "/"
+	}
+}
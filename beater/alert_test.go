@@ -1,7 +1,11 @@
 package beater
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -9,8 +13,80 @@ import (
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/common"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+var updateGolden = flag.Bool("update", false, "update golden files in testdata/golden")
+
+// TestBeatEvents_Golden converts alerts response testdata/golden/<pipeline>.json
+// of every pipeline and compares the events with <pipeline>.golden.json, or
+// <pipeline>.ecs.golden.json with mapping_version 2. Run with -update to
+// write the golden files after changing the mapping.
+func TestBeatEvents_Golden(t *testing.T) {
+	aliases := legacyFieldAliases()
+	for _, pipeline := range []string{"dns", "ip", "http", "tls"} {
+		for _, ecs := range []bool{false, true} {
+			pipeline, ecs := pipeline, ecs
+			name := pipeline
+			if ecs {
+				name += ".ecs"
+			}
+			t.Run(name, func(t *testing.T) {
+				data, err := ioutil.ReadFile(filepath.Join("testdata", "golden", pipeline+".json"))
+				require.NoError(t, err)
+				body := &alertResponse{}
+				require.NoError(t, json.Unmarshal(data, body))
+
+				c := newConverter(nil)
+				c.ecs = ecs
+				events := c.beatEvents(body)
+				if ecs {
+					// Aliases cannot be written.
+					for _, e := range events {
+						for k := range e.Fields {
+							assert.NotContains(t, aliases, k)
+						}
+					}
+				}
+
+				got, err := json.MarshalIndent(events, "", "  ")
+				require.NoError(t, err)
+				assertGolden(t, filepath.Join("testdata", "golden", name+".golden.json"), got)
+			})
+		}
+	}
+}
+
+// assertGolden compares data with the golden file, which is written first
+// when running with -update.
+func assertGolden(t *testing.T, golden string, data []byte) {
+	t.Helper()
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	if *updateGolden {
+		require.NoError(t, ioutil.WriteFile(golden, data, 0644))
+	}
+	want, err := ioutil.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), string(data))
+}
+
+// assertNormalised compares values of the fields normalised to the types of
+// their fields, which comparing JSON does not tell apart, e.g. int64 and
+// float64 ports.
+func assertNormalised(t *testing.T, expected, events []beat.Event) {
+	t.Helper()
+	require.Len(t, events, len(expected))
+	for i, e := range expected {
+		for k, v := range e.Fields {
+			if _, ok := fieldValueTypes[k]; ok || k == "alphasoc.event.ts" {
+				assert.Equal(t, v, events[i].Fields[k], k)
+			}
+		}
+	}
+}
+
 func TestBeatEvents_DNSEvents(t *testing.T) {
 	response := `{
 		"follow": "6-8263d641",
@@ -58,7 +134,7 @@ func TestBeatEvents_DNSEvents(t *testing.T) {
 		t.Fatal("cannot decode response", err)
 	}
 
-	events := body.beatEvents()
+	events := newConverter(nil).beatEvents(body)
 
 	if len(events) != 2 {
 		t.Fatalf("expected 2 events, got %v", len(events))
@@ -67,17 +143,37 @@ func TestBeatEvents_DNSEvents(t *testing.T) {
 	expected := []beat.Event{
 		{
 			Timestamp: time.Date(2021, time.April, 7, 9, 55, 37, 0, time.UTC),
+			Meta: common.MapStr{
+				"_id": "674fe65f00272c6ac82e65118a432ebc166f26d7c14e929d52d8f4967f5ba976",
+			},
 			Fields: common.MapStr{
-				"alphasoc.event.ts": "2021-04-07 09:55:37",
+				"alphasoc.event.ts": time.Date(2021, time.April, 7, 9, 55, 37, 0, time.UTC),
 				"alphasoc.pipeline": "dns",
 
 				"alphasoc.threat.value":    "suspicious_domain_volume",
 				"alphasoc.threat.severity": severity(3),
 				"alphasoc.threat.title":    "Multiple requests to suspicious domains",
 
+				"event.kind":     "alert",
+				"event.category": []string{"network"},
+				"event.type":     []string{"protocol", "info"},
+				"event.severity": severity(3),
+
+				"rule.id":       "suspicious_domain_volume",
+				"rule.name":     "Multiple requests to suspicious domains",
+				"rule.category": "threat",
+
+				"threat.framework":           "MITRE ATT&CK",
+				"threat.tactic.id":           "TA0011",
+				"threat.tactic.name":         "Command and Control",
+				"threat.tactic.reference":    "https://attack.mitre.org/tactics/TA0011/",
+				"threat.technique.id":        "T1568",
+				"threat.technique.name":      "Dynamic Resolution",
+				"threat.technique.reference": "https://attack.mitre.org/techniques/T1568/",
+
 				"source.ip":            "10.14.1.39",
 				"source.address":       "win-3xchk5-lp",
-				"source.mac":           "da:23:68:50:c4:77",
+				"source.mac":           "DA-23-68-50-C4-77",
 				"alphasoc.event.query": "hsxfrfokdkojcj.net",
 				"dns.question.type":    "A",
 
@@ -90,17 +186,37 @@ func TestBeatEvents_DNSEvents(t *testing.T) {
 		},
 		{
 			Timestamp: time.Date(2021, time.April, 7, 9, 55, 37, 0, time.UTC),
+			Meta: common.MapStr{
+				"_id": "0d7bbb84ff2639b8f2f3d44cfc494e13cb10b955c6c880af67b59e275bb5626e",
+			},
 			Fields: common.MapStr{
-				"alphasoc.event.ts": "2021-04-07 09:55:37",
+				"alphasoc.event.ts": time.Date(2021, time.April, 7, 9, 55, 37, 0, time.UTC),
 				"alphasoc.pipeline": "dns",
 
 				"alphasoc.threat.value":    "unreachable_domain_volume",
 				"alphasoc.threat.severity": severity(2),
 				"alphasoc.threat.title":    "Multiple requests to unreachable domains",
 
+				"event.kind":     "alert",
+				"event.category": []string{"network"},
+				"event.type":     []string{"protocol", "info"},
+				"event.severity": severity(2),
+
+				"rule.id":       "unreachable_domain_volume",
+				"rule.name":     "Multiple requests to unreachable domains",
+				"rule.category": "threat",
+
+				"threat.framework":           "MITRE ATT&CK",
+				"threat.tactic.id":           "TA0011",
+				"threat.tactic.name":         "Command and Control",
+				"threat.tactic.reference":    "https://attack.mitre.org/tactics/TA0011/",
+				"threat.technique.id":        "T1568",
+				"threat.technique.name":      "Dynamic Resolution",
+				"threat.technique.reference": "https://attack.mitre.org/techniques/T1568/",
+
 				"source.ip":            "10.14.1.39",
 				"source.address":       "win-3xchk5-lp",
-				"source.mac":           "da:23:68:50:c4:77",
+				"source.mac":           "DA-23-68-50-C4-77",
 				"alphasoc.event.query": "hsxfrfokdkojcj.net",
 				"dns.question.type":    "A",
 
@@ -113,6 +229,8 @@ func TestBeatEvents_DNSEvents(t *testing.T) {
 		},
 	}
 
+	assertNormalised(t, expected, events)
+
 	eventsJSON, err := json.Marshal(events)
 	if err != nil {
 		t.Fatal("marshaling events to json")
@@ -172,31 +290,51 @@ func TestBeatEvents_IPEvent(t *testing.T) {
 		t.Fatal("cannot decode response", err)
 	}
 
-	events := body.beatEvents()
+	events := newConverter(nil).beatEvents(body)
 
 	expected := []beat.Event{
 		{
 			Timestamp: time.Date(2021, time.April, 7, 9, 57, 17, 0, time.UTC),
+			Meta: common.MapStr{
+				"_id": "758f40be263cbbd662b3e899c8984be6b55518a426ce70d92f4979e6c08fff53",
+			},
 			Fields: common.MapStr{
-				"alphasoc.event.ts": "2021-04-07 09:57:17",
+				"alphasoc.event.ts": time.Date(2021, time.April, 7, 9, 57, 17, 0, time.UTC),
 				"alphasoc.pipeline": "ip",
 
 				"alphasoc.threat.value":    "sinkholed_destination",
 				"alphasoc.threat.severity": severity(4),
 				"alphasoc.threat.title":    "Traffic to a known sinkhole indicating infection",
 
+				"event.kind":     "alert",
+				"event.category": []string{"network"},
+				"event.type":     []string{"connection"},
+				"event.severity": severity(4),
+
+				"rule.id":       "sinkholed_destination",
+				"rule.name":     "Traffic to a known sinkhole indicating infection",
+				"rule.category": "threat",
+
+				"threat.framework":           "MITRE ATT&CK",
+				"threat.tactic.id":           "TA0011",
+				"threat.tactic.name":         "Command and Control",
+				"threat.tactic.reference":    "https://attack.mitre.org/tactics/TA0011/",
+				"threat.technique.id":        "T1071",
+				"threat.technique.name":      "Application Layer Protocol",
+				"threat.technique.reference": "https://attack.mitre.org/techniques/T1071/",
+
 				"source.ip":                  "10.100.92.3",
-				"source.port":                52065,
+				"source.port":                int64(52065),
 				"alphasoc.event.src.user":    "danknicholas",
 				"destination.ip":             "50.116.17.41",
 				"alphasoc.event.dest.ip_raw": "50.116.17.41",
-				"destination.port":           8009,
+				"destination.port":           int64(8009),
 				"network.transport":          "tcp",
 				"network.protocol":           "tls1.3",
 				"alphasoc.event.action":      "allowed",
-				"event.duration":             2.48475075448,
-				"destination.bytes":          27307,
-				"source.bytes":               5419,
+				"event.duration":             int64(2484750754),
+				"destination.bytes":          int64(27307),
+				"source.bytes":               int64(5419),
 
 				"alphasoc.wisdom.flags": []string{
 					"sinkholed",
@@ -206,6 +344,8 @@ func TestBeatEvents_IPEvent(t *testing.T) {
 		},
 	}
 
+	assertNormalised(t, expected, events)
+
 	eventsJSON, err := json.Marshal(events)
 	if err != nil {
 		t.Fatal("marshaling events to json")
@@ -268,27 +408,47 @@ func TestBeatEvents_TLSEvent(t *testing.T) {
 		t.Fatal("cannot decode response", err)
 	}
 
-	events := body.beatEvents()
+	events := newConverter(nil).beatEvents(body)
 
 	expected := []beat.Event{
 		{
 			Timestamp: time.Date(2021, time.April, 7, 9, 58, 18, 0, time.UTC),
+			Meta: common.MapStr{
+				"_id": "d87b5455ae98b8d05eadb0754473ab29168fd0424d51e2009edf97acafcd8aff",
+			},
 			Fields: common.MapStr{
-				"alphasoc.event.ts": "2021-04-07 09:58:18",
+				"alphasoc.event.ts": time.Date(2021, time.April, 7, 9, 58, 18, 0, time.UTC),
 				"alphasoc.pipeline": "tls",
 
 				"alphasoc.threat.value":    "c2_communication",
 				"alphasoc.threat.severity": severity(5),
 				"alphasoc.threat.title":    "C2 communication attempt indicating infection",
 
+				"event.kind":     "alert",
+				"event.category": []string{"network"},
+				"event.type":     []string{"protocol", "info"},
+				"event.severity": severity(5),
+
+				"rule.id":       "c2_communication",
+				"rule.name":     "C2 communication attempt indicating infection",
+				"rule.category": "threat",
+
+				"threat.framework":           "MITRE ATT&CK",
+				"threat.tactic.id":           "TA0011",
+				"threat.tactic.name":         "Command and Control",
+				"threat.tactic.reference":    "https://attack.mitre.org/tactics/TA0011/",
+				"threat.technique.id":        "T1071",
+				"threat.technique.name":      "Application Layer Protocol",
+				"threat.technique.reference": "https://attack.mitre.org/techniques/T1071/",
+
 				"source.ip":                 "10.36.86.38",
-				"source.port":               57849,
-				"destination.port":          0,
+				"source.port":               int64(57849),
+				"destination.port":          int64(0),
 				"alphasoc.event.cert_hash":  "9fcc5c1e8ec32f56e975ba43c923dbfa16a8f946",
 				"alphasoc.event.issuer":     "CN=Let's Encrypt Authority X3,O=Let's Encrypt,C=US",
 				"alphasoc.event.subject":    "C=US,ST=TX,L=Texas,O=lol,OU=,CN=topbackupintheworld.com",
-				"alphasoc.event.valid_from": "2021-03-30T00:34:02Z",
-				"alphasoc.event.valid_to":   "2021-05-29T00:34:02Z",
+				"alphasoc.event.valid_from": time.Date(2021, time.March, 30, 0, 34, 2, 0, time.UTC),
+				"alphasoc.event.valid_to":   time.Date(2021, time.May, 29, 0, 34, 2, 0, time.UTC),
 				"alphasoc.event.ja3":        "724dedf93fb5a3636a0f1ee8fcec8801",
 				"alphasoc.event.ja3s":       "015535be754766257f9bfdf3470cd428e0f1cfd4",
 
@@ -303,6 +463,8 @@ func TestBeatEvents_TLSEvent(t *testing.T) {
 		},
 	}
 
+	assertNormalised(t, expected, events)
+
 	eventsJSON, err := json.Marshal(events)
 	if err != nil {
 		t.Fatal("marshaling events to json")
@@ -315,3 +477,123 @@ func TestBeatEvents_TLSEvent(t *testing.T) {
 
 	assert.JSONEq(t, string(expectedJSON), string(eventsJSON))
 }
+
+func TestBeatEvents_FingerprintFieldOrder(t *testing.T) {
+	responses := []string{`{
+		"follow": "6-8263d641",
+		"alerts": [
+			{
+				"eventType": "ip",
+				"event": {
+					"ts": "2021-04-07T09:57:17Z",
+					"srcIP": "10.100.92.3",
+					"srcPort": 52065,
+					"destIP": "50.116.17.41",
+					"destPort": 8009,
+					"proto": "tcp"
+				},
+				"threats": ["sinkholed_destination", "c2_communication"]
+			}
+		]
+	}`, `{
+		"alerts": [
+			{
+				"threats": ["c2_communication", "sinkholed_destination"],
+				"event": {
+					"proto": "tcp",
+					"destPort": 8009,
+					"destIP": "50.116.17.41",
+					"srcPort": 52065,
+					"srcIP": "10.100.92.3",
+					"ts": "2021-04-07T09:57:17Z"
+				},
+				"eventType": "ip"
+			}
+		],
+		"follow": "7-1e6a8c12"
+	}`}
+
+	ids := make([]map[string]string, len(responses))
+	for i, response := range responses {
+		body := &alertResponse{Alerts: &[]eventAlert{}}
+		d := json.NewDecoder(strings.NewReader(response))
+		if err := d.Decode(body); err != nil {
+			t.Fatal("cannot decode response", err)
+		}
+
+		ids[i] = map[string]string{}
+		for _, e := range newConverter(nil).beatEvents(body) {
+			threat, _ := e.Fields.GetValue("alphasoc.threat.value")
+			ids[i][threat.(string)] = e.Meta["_id"].(string)
+		}
+	}
+
+	assert.Equal(t, ids[0], ids[1])
+	assert.NotEqual(t, ids[0]["sinkholed_destination"], ids[0]["c2_communication"])
+}
+
+func TestBeatEvents_FingerprintFields(t *testing.T) {
+	alert := func(srcPort int, duration float64) *alertResponse {
+		return &alertResponse{
+			Alerts: &[]eventAlert{
+				{
+					Type: "ip",
+					Event: map[string]interface{}{
+						"ts":       "2021-04-07T09:57:17Z",
+						"srcIP":    "10.100.92.3",
+						"srcPort":  srcPort,
+						"destIP":   "50.116.17.41",
+						"duration": duration,
+					},
+					Threats: []string{"sinkholed_destination"},
+				},
+			},
+		}
+	}
+
+	id := func(c *converter, ar *alertResponse) string {
+		events := c.beatEvents(ar)
+		if len(events) != 1 {
+			t.Fatalf("expected 1 event, got %v", len(events))
+		}
+		return events[0].Meta["_id"].(string)
+	}
+
+	c := newConverter(nil)
+	assert.Equal(t, id(c, alert(52065, 2.4)), id(c, alert(52065, 1.2)),
+		"field not used in fingerprint changes ID")
+	assert.NotEqual(t, id(c, alert(52065, 2.4)), id(c, alert(52066, 2.4)),
+		"field used in fingerprint does not change ID")
+
+	c = newConverter(map[string][]string{"ip": {"ts", "srcIP", "destIP"}})
+	assert.Equal(t, id(c, alert(52065, 2.4)), id(c, alert(52066, 2.4)),
+		"field removed from fingerprint changes ID")
+}
+
+func TestBeatEvents_CategorizationNotShared(t *testing.T) {
+	ar := &alertResponse{
+		Alerts: &[]eventAlert{
+			{Type: "dns", Event: map[string]interface{}{"ts": "2021-04-07T09:55:37Z"}, Threats: []string{"c2_communication", "dga"}},
+			{Type: "vpn", Event: map[string]interface{}{"ts": "2021-04-07T09:56:37Z"}, Threats: []string{"c2_communication", "dga"}},
+		},
+	}
+	events := newConverter(nil).beatEvents(ar)
+	require.Len(t, events, 4)
+
+	// Processors may modify the values in place.
+	for _, e := range events {
+		if e.Fields["alphasoc.threat.value"] == "c2_communication" {
+			e.Fields["event.category"].([]string)[0] = "intrusion_detection"
+			e.Fields["event.type"].([]string)[0] = "indicator"
+		}
+	}
+
+	assert.Equal(t, []string{"network"}, events[1].Fields["event.category"])
+	assert.Equal(t, []string{"protocol", "info"}, events[1].Fields["event.type"])
+	assert.Equal(t, []string{"network"}, events[3].Fields["event.category"])
+	assert.Equal(t, []string{"info"}, events[3].Fields["event.type"])
+	assert.Equal(t, ecsCategorization{category: []string{"network"}, types: []string{"protocol", "info"}},
+		eventCategories["dns"])
+	assert.Equal(t, ecsCategorization{category: []string{"network"}, types: []string{"info"}},
+		defaultEventCategory)
+}
@@ -1,126 +1,256 @@
 package beater
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"net/url"
-	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/common"
-	"github.com/elastic/beats/v7/libbeat/common/backoff"
 	"github.com/elastic/beats/v7/libbeat/logp"
 
 	"github.com/alphasoc/alphasocbeat/checkpoint"
 	"github.com/alphasoc/alphasocbeat/config"
 )
 
-const APIPath = "/v1/alerts"
-
 // alphasocbeat configuration.
 type alphasocbeat struct {
-	done       chan struct{}
-	config     config.Config
-	client     beat.Client
-	checkpoint *checkpoint.Checkpoint
+	config      config.Config
+	inputs      []*input
+	checkpoints []*checkpoint.Checkpoint
+
+	// recorder records raw API responses if enabled.
+	recorder *recorder
+
+	// ctx is cancelled by Stop to interrupt the pending requests and backoff.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// publisherCtx is close reference of the publisher clients, cancelling
+	// it aborts publishing still blocked when shutdown_timeout elapses.
+	publisherCtx   context.Context
+	closePublisher context.CancelFunc
 
-	apiURL string
-	apiKey string
+	// shutdownTimer closes the publisher when shutdown_timeout elapses
+	// after Stop was called or the inputs stopped, whichever is first.
+	shutdownOnce  sync.Once
+	shutdownTimer *time.Timer
+
+	// stopped is closed when Run returns.
+	stopped chan struct{}
 
 	log *logp.Logger
 }
 
 // New creates an instance of alphasocbeat.
 func New(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
-	c := config.Config{}
-	if err := cfg.Unpack(&c); err != nil {
-		return nil, fmt.Errorf("error reading config file: %w", err)
+	c, err := unpackConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := useMappingVersion(b, c); err != nil {
+		return nil, err
 	}
 
-	cp, err := checkpoint.NewCheckpoint(c.RegistryFile, 1, 1*time.Minute)
-	if err != nil {
-		return nil, fmt.Errorf("creating checkpoint: %w", err)
+	return newBeat(c)
+}
+
+// unpackConfig reads beat config on top of the default one.
+func unpackConfig(cfg *common.Config) (config.Config, error) {
+	c := config.DefaultConfig
+	if err := cfg.Unpack(&c); err != nil {
+		return c, fmt.Errorf("error reading config file: %w", err)
 	}
+	if err := checkMappings(c); err != nil {
+		return c, fmt.Errorf("error reading config file: %w", err)
+	}
+	return c, nil
+}
 
+// newBeat creates alphasocbeat with an input per configured account.
+func newBeat(c config.Config) (*alphasocbeat, error) {
 	bt := &alphasocbeat{
-		done:       make(chan struct{}),
-		config:     c,
-		checkpoint: cp,
-		apiURL:     c.APIURL,
-		apiKey:     c.APIKey,
-		log:        logp.NewLogger("alphasocbeat"),
+		config:  c,
+		stopped: make(chan struct{}),
+		log:     logp.NewLogger("alphasocbeat"),
 	}
+	bt.ctx, bt.cancel = context.WithCancel(context.Background())
+	bt.publisherCtx, bt.closePublisher = context.WithCancel(context.Background())
+
+	if c.Record.Enabled {
+		// File is created on the first response.
+		var err error
+		if bt.recorder, err = newRecorder(c.Record); err != nil {
+			return nil, err
+		}
+	}
+
+	inputs := c.InputList()
+	checkpoints := map[string]*checkpoint.Checkpoint{}
+	registryInputs := map[*checkpoint.Checkpoint][]*input{}
+	for _, ic := range inputs {
+		cp, ok := checkpoints[ic.RegistryFile]
+		if !ok {
+			var err error
+			cp, err = openRegistry(c.Registry, ic.RegistryFile)
+			if err != nil {
+				bt.shutdownCheckpoints()
+				return nil, err
+			}
+			checkpoints[ic.RegistryFile] = cp
+			bt.checkpoints = append(bt.checkpoints, cp)
+		}
 
+		in, err := newInput(c, ic, cp.Cursor(ic.Cursor()), bt.recorder)
+		if err != nil {
+			bt.shutdownCheckpoints()
+			if ic.Name != "" {
+				err = fmt.Errorf("input %s: %w", ic.Name, err)
+			}
+			return nil, err
+		}
+		bt.inputs = append(bt.inputs, in)
+		registryInputs[cp] = append(registryInputs[cp], in)
+	}
+
+	for cp, inputs := range registryInputs {
+		reportRegistryErrors(cp, inputs)
+	}
 	return bt, nil
 }
 
-// Run starts alphasocbeat.
-func (bt *alphasocbeat) Run(b *beat.Beat) error {
-	bt.log.Info("alphasocbeat is running! Hit CTRL-C to stop it.")
+// reportRegistryErrors logs failed writes of the registry through the
+// loggers of the inputs keeping their cursors in it.
+func reportRegistryErrors(cp *checkpoint.Checkpoint, inputs []*input) {
+	location := cp.Location()
+	cp.OnError(func(err error) {
+		for _, in := range inputs {
+			in.log.Errorw("Failed to write registry, the position is written again on the next update",
+				"registry", location, logp.Error(err))
+		}
+	})
+}
 
-	var err error
-	bt.client, err = b.Publisher.Connect()
+// openRegistry creates checkpoint of the registry file in the configured
+// store.
+func openRegistry(sc checkpoint.StoreConfig, file string) (*checkpoint.Checkpoint, error) {
+	store, err := checkpoint.NewStore(sc, file)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("creating checkpoint store: %w", err)
 	}
 
-	follow := bt.checkpoint.State()
-
-	req, err := http.NewRequest("GET", bt.apiURL, nil)
+	cp, err := checkpoint.NewCheckpointWithStore(store, 1, 1*time.Minute)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("creating checkpoint: %w", err)
 	}
+	return cp, nil
+}
 
-	req.URL.Path = path.Join(req.URL.Path, APIPath)
-	req.URL.User = url.User(bt.apiKey)
-	req.Header.Add("Content-Encoding", "gzip")
+// shutdownCheckpoints flushes and stops all checkpoints.
+func (bt *alphasocbeat) shutdownCheckpoints() {
+	for _, cp := range bt.checkpoints {
+		cp.Shutdown()
+	}
+}
 
-	back := backoff.NewExpBackoff(bt.done, 1*time.Second, 60*time.Second)
-	for {
-		if !back.Wait() {
-			return nil
-		}
+// Run starts alphasocbeat. Inputs run concurrently, an input failing with
+// an error that cannot be retried does not stop the others. Run returns
+// when all inputs stopped.
+func (bt *alphasocbeat) Run(b *beat.Beat) error {
+	defer close(bt.stopped)
+	bt.log.Info("alphasocbeat is running! Hit CTRL-C to stop it.")
 
-		q := req.URL.Query()
-		q.Del("follow")
-		if follow != "" {
-			q.Add("follow", follow)
-			req.URL.RawQuery = q.Encode()
+	for i, in := range bt.inputs {
+		if err := in.connect(b.Publisher, bt.publisherCtx); err != nil {
+			for _, in := range bt.inputs[:i] {
+				in.client.Close()
+			}
+			bt.shutdownCheckpoints()
+			return err
 		}
+	}
 
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			bt.log.Errorw("http.Do", logp.Error(err))
-			continue
-		}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, in := range bt.inputs {
+		wg.Add(1)
+		go func(in *input) {
+			defer wg.Done()
 
-		if resp.StatusCode == http.StatusTooManyRequests {
-			continue
-		} else if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("response status code is not 200, got %v", resp.Status)
-		}
+			err := in.run(bt.ctx)
+			if err == nil {
+				return
+			}
+			if in.name != "" {
+				err = fmt.Errorf("input %s: %w", in.name, err)
+			}
+			if len(bt.inputs) > 1 {
+				in.log.Errorw("Input stopped, the other inputs keep running", logp.Error(err))
+			}
+
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}(in)
+	}
+	wg.Wait()
 
-		body := &alertResponse{Alerts: &[]eventAlert{}}
-		d := json.NewDecoder(resp.Body)
-		if err := d.Decode(body); err != nil {
-			return fmt.Errorf("json.Decode: %w", err)
+	bt.startShutdown()
+	defer bt.shutdownTimer.Stop()
+	for _, in := range bt.inputs {
+		in.waitACK(bt.publisherCtx)
+	}
+
+	// Clients are closed before the checkpoints are flushed, so positions
+	// of pages acknowledged while closing are not lost.
+	for _, in := range bt.inputs {
+		in.client.Close()
+	}
+	bt.shutdownCheckpoints()
+	if bt.recorder != nil {
+		if err := bt.recorder.Close(); err != nil {
+			bt.log.Errorw("Failed to close recording file", logp.Error(err))
 		}
+	}
 
-		follow = body.Follow
-		bt.checkpoint.Persist(follow)
+	return joinErrors(errs)
+}
 
-		bt.client.PublishAll(body.beatEvents())
+// joinErrors returns the only error, or an error listing all of them.
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
 
-		if body.More {
-			back.Reset()
-		}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
 	}
+	return fmt.Errorf("%d inputs failed: %s", len(errs), strings.Join(msgs, "; "))
 }
 
-// Stop stops alphasocbeat.
+// Stop stops alphasocbeat. It cancels the pending requests and waits until
+// Run has published the current pages and flushed the checkpoints.
+// Publishing and waiting for acknowledgements still blocked after
+// shutdown_timeout are aborted.
 func (bt *alphasocbeat) Stop() {
-	bt.client.Close()
-	close(bt.done)
+	bt.cancel()
+	bt.startShutdown()
+	<-bt.stopped
+}
+
+// startShutdown starts shutdown_timeout, once, after which the publisher is
+// closed.
+func (bt *alphasocbeat) startShutdown() {
+	bt.shutdownOnce.Do(func() {
+		bt.shutdownTimer = time.AfterFunc(bt.config.ShutdownTimeout, bt.closePublisher)
+	})
 }
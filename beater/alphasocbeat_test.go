@@ -0,0 +1,550 @@
+package beater
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc/mockapi"
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+)
+
+// fakePipeline connects fakeClient with ACK handler of the beat. client
+// is the last connected one.
+type fakePipeline struct {
+	mu         sync.Mutex
+	client     *fakeClient
+	clients    []*fakeClient
+	autoACK    bool
+	ackOnClose bool
+}
+
+func (p *fakePipeline) ConnectWith(cfg beat.ClientConfig) (beat.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.client = &fakeClient{acker: cfg.ACKHandler, autoACK: p.autoACK, ackOnClose: p.ackOnClose}
+	p.clients = append(p.clients, p.client)
+	return p.client, nil
+}
+
+func (p *fakePipeline) Connect() (beat.Client, error) {
+	return p.ConnectWith(beat.ClientConfig{})
+}
+
+// published returns the events published so far by all clients.
+func (p *fakePipeline) published() []beat.Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var events []beat.Event
+	for _, c := range p.clients {
+		events = append(events, c.events()...)
+	}
+	return events
+}
+
+// pageAlertTime is the detection time of the alert served by alertPage.
+var pageAlertTime = time.Date(2021, time.April, 7, 9, 55, 37, 0, time.UTC)
+
+// alertPage returns page with single alert followed by more.
+func alertPage(follow string) mockapi.Response {
+	return mockapi.Page(follow, true, mockapi.Alert(pageAlertTime, "hsxfrfokdkojcj.net", "suspicious_domain_volume"))
+}
+
+// newTestBeat creates beat fetching alerts from apiURL with short backoff.
+func newTestBeat(t *testing.T, apiURL string, settings map[string]interface{}) *alphasocbeat {
+	return newTestBeatWith(t, New, apiURL, settings)
+}
+
+// newTestBeatWith creates beat using creator fetching alerts from apiURL.
+// Registry file is created in temporary directory unless given in settings.
+// Unacknowledged events delay stopping the beat only briefly.
+func newTestBeatWith(t *testing.T, creator beat.Creator, apiURL string,
+	settings map[string]interface{}) *alphasocbeat {
+	cfg, err := common.NewConfigFrom(map[string]interface{}{
+		"registry_file":    filepath.Join(t.TempDir(), "checkpoint.yaml"),
+		"api_url":          apiURL,
+		"api_key":          "test-key",
+		"shutdown_timeout": "100ms",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Merge(settings))
+
+	b, err := creator(&beat.Beat{}, cfg)
+	require.NoError(t, err)
+
+	bt := b.(*alphasocbeat)
+	for _, in := range bt.inputs {
+		in.backoffInit = time.Millisecond
+		in.backoffMax = 10 * time.Millisecond
+	}
+	t.Cleanup(bt.shutdownCheckpoints)
+	return bt
+}
+
+// runBeat runs bt in background, the returned channel receives result of Run.
+func runBeat(bt *alphasocbeat, p *fakePipeline) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- bt.Run(&beat.Beat{Publisher: p})
+	}()
+	return done
+}
+
+// newMockAPI starts mock API serving the script.
+func newMockAPI(t *testing.T, script ...mockapi.Response) (*mockapi.Server, string) {
+	api := mockapi.New(script...)
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	return api, srv.URL
+}
+
+// queries returns query parameters of the requests received by api.
+func queries(api *mockapi.Server) []mockapi.Request {
+	var queries []mockapi.Request
+	for _, r := range api.Requests() {
+		queries = append(queries, mockapi.Request{Follow: r.Follow, After: r.After, Before: r.Before})
+	}
+	return queries
+}
+
+// follows returns follow tokens of the requests received by api.
+func follows(api *mockapi.Server) []string {
+	var follows []string
+	for _, r := range api.Requests() {
+		follows = append(follows, r.Follow)
+	}
+	return follows
+}
+
+func TestRun_MockAPI(t *testing.T) {
+	ts := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	api, apiURL := newMockAPI(t,
+		mockapi.Page("1-a", true,
+			mockapi.Alert(ts, "a.example.net", "c2_communication"),
+			mockapi.Alert(ts.Add(time.Minute), "b.example.net", "suspicious_domain_volume")),
+		mockapi.RateLimited(0),
+		mockapi.ServerError(http.StatusBadGateway),
+		mockapi.Page("2-b", true, mockapi.Alert(ts.Add(2*time.Minute), "c.example.net", "c2_communication")),
+		mockapi.Page("3-c", false, mockapi.Alert(ts.Add(3*time.Minute), "d.example.net", "c2_communication")),
+	)
+	registry := filepath.Join(t.TempDir(), "checkpoint.yaml")
+	settings := map[string]interface{}{"registry_file": registry}
+
+	bt := newTestBeatWith(t, New, apiURL, settings)
+	p := &fakePipeline{autoACK: true}
+	done := runBeat(bt, p)
+
+	require.Eventually(t, func() bool { return len(p.published()) == 4 && api.Pending() == 0 },
+		5*time.Second, 5*time.Millisecond)
+	bt.Stop()
+	require.NoError(t, <-done)
+
+	var queries []interface{}
+	for _, e := range p.published() {
+		queries = append(queries, e.Fields["alphasoc.event.query"])
+	}
+	assert.Equal(t, []interface{}{"a.example.net", "b.example.net", "c.example.net", "d.example.net"}, queries)
+	assert.Equal(t, []string{"", "1-a", "1-a", "1-a", "2-b"}, follows(api)[:5])
+
+	s := readRegistry(t, bt)
+	assert.Equal(t, "3-c", s.Follow)
+	assert.Equal(t, ts.Add(3*time.Minute), s.LastAlertTime)
+	assert.Equal(t, int64(4), s.Events)
+	assert.GreaterOrEqual(t, s.Pages, int64(3))
+
+	// Restarted beat continues from the registry.
+	api, apiURL = newMockAPI(t)
+	bt = newTestBeatWith(t, New, apiURL, settings)
+	done = runBeat(bt, &fakePipeline{autoACK: true})
+	require.Eventually(t, func() bool { return len(api.Requests()) > 0 },
+		5*time.Second, 5*time.Millisecond)
+	bt.Stop()
+	require.NoError(t, <-done)
+	assert.Equal(t, "3-c", api.Requests()[0].Follow)
+}
+
+func TestRun_MockAPIMalformed(t *testing.T) {
+	ts := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	api, apiURL := newMockAPI(t,
+		mockapi.Page("1-a", true, mockapi.Alert(ts, "a.example.net", "c2_communication")),
+		mockapi.Malformed(),
+		mockapi.Page("2-b", false, mockapi.Alert(ts.Add(time.Minute), "b.example.net", "c2_communication")),
+	)
+	bt := newTestBeatWith(t, New, apiURL, nil)
+	p := &fakePipeline{autoACK: true}
+	done := runBeat(bt, p)
+
+	// Truncated page is fetched again.
+	require.Eventually(t, func() bool { return len(p.published()) == 2 },
+		5*time.Second, 5*time.Millisecond)
+	bt.Stop()
+	require.NoError(t, <-done)
+
+	assert.Equal(t, []interface{}{"a.example.net", "b.example.net"}, publishedQueries(p))
+	assert.Equal(t, []string{"", "1-a", "1-a"}, follows(api)[:3])
+	assert.Equal(t, "2-b", readRegistry(t, bt).Follow)
+}
+
+func TestRun_RetriesServerAndNetworkErrors(t *testing.T) {
+	_, apiURL := newMockAPI(t,
+		mockapi.ServerError(http.StatusBadGateway),
+		mockapi.Disconnected(),
+		mockapi.ServerError(http.StatusInternalServerError),
+		alertPage("1-a"),
+	)
+	bt := newTestBeat(t, apiURL, nil)
+	p := &fakePipeline{}
+	done := runBeat(bt, p)
+
+	require.Eventually(t, func() bool { return len(p.published()) == 1 },
+		5*time.Second, 5*time.Millisecond)
+
+	bt.Stop()
+	assert.NoError(t, <-done)
+}
+
+func TestRun_RetryAfter(t *testing.T) {
+	for _, code := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			api, apiURL := newMockAPI(t,
+				mockapi.Response{Status: code, Header: map[string]string{"Retry-After": "1"}},
+				alertPage("1-a"),
+			)
+			bt := newTestBeat(t, apiURL, nil)
+			p := &fakePipeline{}
+			done := runBeat(bt, p)
+
+			require.Eventually(t, func() bool { return len(p.published()) == 1 },
+				5*time.Second, 5*time.Millisecond)
+
+			bt.Stop()
+			assert.NoError(t, <-done)
+
+			requests := api.Requests()
+			require.True(t, len(requests) >= 2)
+			retry := requests[1].Time.Sub(requests[0].Time)
+			assert.True(t, retry >= time.Second, "request retried after %v", retry)
+		})
+	}
+}
+
+func TestRun_AuthError(t *testing.T) {
+	t.Run("retry", func(t *testing.T) {
+		_, apiURL := newMockAPI(t,
+			mockapi.ClientError(http.StatusUnauthorized),
+			mockapi.ClientError(http.StatusForbidden),
+			alertPage("1-a"),
+		)
+		bt := newTestBeat(t, apiURL, nil)
+		p := &fakePipeline{}
+		done := runBeat(bt, p)
+
+		require.Eventually(t, func() bool { return len(p.published()) == 1 },
+			5*time.Second, 5*time.Millisecond)
+
+		bt.Stop()
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		_, apiURL := newMockAPI(t, mockapi.ClientError(http.StatusUnauthorized))
+		bt := newTestBeat(t, apiURL, map[string]interface{}{
+			"fail_on_auth_error": true,
+		})
+		p := &fakePipeline{}
+
+		select {
+		case err := <-runBeat(bt, p):
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "API key rejected")
+		case <-time.After(5 * time.Second):
+			t.Fatal("beat did not stop on auth error")
+		}
+		bt.Stop()
+	})
+}
+
+func TestRun_InvalidFollowResume(t *testing.T) {
+	api, apiURL := newMockAPI(t,
+		alertPage("1-a"),
+		mockapi.InvalidFollow(),
+		alertPage("2-b"),
+	)
+	bt := newTestBeat(t, apiURL, nil)
+	p := &fakePipeline{}
+	done := runBeat(bt, p)
+
+	// Alert from the first page, status event and alert from the resumed page.
+	require.Eventually(t, func() bool { return len(p.published()) == 3 },
+		5*time.Second, 5*time.Millisecond)
+
+	// Time of the last alert is persisted together with follow token.
+	p.client.ackInOrder(3)
+	require.Eventually(t, func() bool { return bt.inputs[0].cursor.State().Follow == "2-b" },
+		5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, pageAlertTime, bt.inputs[0].cursor.State().LastAlertTime)
+
+	bt.Stop()
+	assert.NoError(t, <-done)
+
+	assert.Equal(t, mockapi.Request{After: "2021-04-07T09:55:37Z"}, queries(api)[2])
+
+	status := p.published()[1]
+	assert.Equal(t, "follow_rejected", status.Fields["alphasoc.status.type"])
+	assert.Equal(t, "1-a", status.Fields["alphasoc.status.follow"])
+	assert.Equal(t, pageAlertTime, status.Fields["alphasoc.status.resume_from"])
+	assert.Nil(t, status.Private)
+}
+
+func TestRun_InvalidFollowFail(t *testing.T) {
+	_, apiURL := newMockAPI(t, alertPage("1-a"), mockapi.InvalidFollow())
+	bt := newTestBeat(t, apiURL, map[string]interface{}{
+		"invalid_follow": "fail",
+	})
+	p := &fakePipeline{}
+
+	select {
+	case err := <-runBeat(bt, p):
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid cursor")
+	case <-time.After(5 * time.Second):
+		t.Fatal("beat did not stop on invalid follow")
+	}
+	bt.Stop()
+}
+
+func TestRun_ClientError(t *testing.T) {
+	_, apiURL := newMockAPI(t, mockapi.ClientError(http.StatusNotFound))
+	bt := newTestBeat(t, apiURL, nil)
+	p := &fakePipeline{}
+
+	select {
+	case err := <-runBeat(bt, p):
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("beat did not stop on client error")
+	}
+	bt.Stop()
+}
+
+// readRegistry returns the state of the first input persisted in the
+// registry file of bt.
+func readRegistry(t *testing.T, bt *alphasocbeat) checkpoint.State {
+	cursor := bt.inputs[0].cursor
+	data, err := ioutil.ReadFile(cursor.Location())
+	require.NoError(t, err)
+
+	var ps checkpoint.PersistedState
+	require.NoError(t, yaml.Unmarshal(data, &ps))
+	assert.Equal(t, checkpoint.Version, ps.Version)
+	return ps.Cursors[cursor.Name()]
+}
+
+func TestStop_CancelsRequest(t *testing.T) {
+	api, apiURL := newMockAPI(t, alertPage("1-a"), mockapi.Hanging())
+	bt := newTestBeat(t, apiURL, nil)
+	p := &fakePipeline{autoACK: true}
+	done := runBeat(bt, p)
+
+	require.Eventually(t, func() bool { return len(api.Requests()) == 2 },
+		5*time.Second, 5*time.Millisecond, "second request not made")
+
+	start := time.Now()
+	bt.Stop()
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.NoError(t, <-done)
+
+	assert.Equal(t, "1-a", readRegistry(t, bt).Follow)
+	assert.True(t, p.client.isClosed())
+}
+
+func TestStop_WaitsForACK(t *testing.T) {
+	_, apiURL := newMockAPI(t, alertPage("1-a"))
+	bt := newTestBeat(t, apiURL, map[string]interface{}{
+		"shutdown_timeout": "5s",
+	})
+	p := &fakePipeline{}
+	done := runBeat(bt, p)
+
+	require.Eventually(t, func() bool { return len(p.published()) == 1 },
+		5*time.Second, 5*time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		bt.Stop()
+		close(stopped)
+	}()
+
+	// Stop waits for the output to acknowledge the published page.
+	select {
+	case <-stopped:
+		t.Fatal("stopped before the page was acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.False(t, p.client.isClosed())
+
+	p.client.ackInOrder(1)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("beat did not stop after the page was acknowledged")
+	}
+	assert.NoError(t, <-done)
+
+	assert.Equal(t, "1-a", readRegistry(t, bt).Follow)
+	assert.True(t, p.client.isClosed())
+}
+
+func TestStop_ShutdownTimeout(t *testing.T) {
+	_, apiURL := newMockAPI(t, alertPage("1-a"))
+	bt := newTestBeat(t, apiURL, nil)
+	p := &fakePipeline{}
+	done := runBeat(bt, p)
+
+	require.Eventually(t, func() bool { return len(p.published()) == 1 },
+		5*time.Second, 5*time.Millisecond)
+
+	// Page never acknowledged is not persisted.
+	bt.Stop()
+	assert.NoError(t, <-done)
+	assert.Equal(t, "", readRegistry(t, bt).Follow)
+	assert.True(t, p.client.isClosed())
+}
+
+func TestStop_ACKWhileClosing(t *testing.T) {
+	_, apiURL := newMockAPI(t, alertPage("1-a"))
+	bt := newTestBeat(t, apiURL, nil)
+	p := &fakePipeline{ackOnClose: true}
+	done := runBeat(bt, p)
+
+	require.Eventually(t, func() bool { return len(p.published()) == 1 },
+		5*time.Second, 5*time.Millisecond)
+
+	// Page acknowledged after shutdown_timeout, while the client closes,
+	// is persisted.
+	bt.Stop()
+	assert.NoError(t, <-done)
+	assert.Equal(t, "1-a", readRegistry(t, bt).Follow)
+}
+
+func TestRun_MultipleInputs(t *testing.T) {
+	unitA, unitAURL := newMockAPI(t, alertPage("1-a"))
+	unitA.Key = "key-a"
+	unitB, unitBURL := newMockAPI(t, alertPage("1-b"), mockapi.ClientError(http.StatusNotFound))
+	unitB.Key = "key-b"
+
+	dir := t.TempDir()
+	bt := newTestBeat(t, unitAURL, map[string]interface{}{
+		"registry_file": filepath.Join(dir, "checkpoint.yaml"),
+		"inputs": []map[string]interface{}{
+			{
+				"name":    "unit-a",
+				"api_key": "key-a",
+				"fields":  map[string]interface{}{"business_unit": "a"},
+			},
+			{
+				"name":              "unit-b",
+				"api_url":           unitBURL,
+				"api_key":           "key-b",
+				"fields":            map[string]interface{}{"business_unit": "b"},
+				"fields_under_root": true,
+			},
+		},
+	})
+	require.Len(t, bt.inputs, 2)
+	require.Len(t, bt.checkpoints, 1)
+	assert.Equal(t, filepath.Join(dir, "checkpoint.yaml"), bt.inputs[1].cursor.Location())
+	assert.Equal(t, "unit-a", bt.inputs[0].cursor.Name())
+	assert.Equal(t, "unit-b", bt.inputs[1].cursor.Name())
+
+	p := &fakePipeline{autoACK: true}
+	done := runBeat(bt, p)
+
+	require.Eventually(t, func() bool {
+		return bt.inputs[0].cursor.State().Follow == "1-a" &&
+			bt.inputs[1].cursor.State().Follow == "1-b"
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// Failing input does not stop the other one.
+	require.Eventually(t, func() bool { return len(unitB.Requests()) == 2 },
+		5*time.Second, 5*time.Millisecond)
+	requests := len(unitA.Requests())
+	require.Eventually(t, func() bool { return len(unitA.Requests()) > requests },
+		5*time.Second, 5*time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("beat stopped with a failing input: %v", err)
+	default:
+	}
+
+	bt.Stop()
+	err := <-done
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "input unit-b")
+
+	// Each input authenticates with its own key, the mock API rejects others.
+	assert.Equal(t, 0, unitA.Pending())
+	assert.Equal(t, 0, unitB.Pending())
+
+	events := p.published()
+	require.Len(t, events, 2)
+	assert.Equal(t, "unit-a", events[0].Fields["alphasoc.tenant"])
+	assert.Equal(t, common.MapStr{"business_unit": "a"}, events[0].Fields["fields"])
+	assert.Equal(t, "unit-b", events[1].Fields["alphasoc.tenant"])
+	assert.Equal(t, "b", events[1].Fields["business_unit"])
+
+	// Document IDs of the same alert differ between accounts.
+	assert.NotEqual(t, events[0].Meta["_id"], events[1].Meta["_id"])
+}
+
+func TestRun_RegistryWriteError(t *testing.T) {
+	require.NoError(t, logp.DevelopmentSetup(logp.ToObserverOutput()))
+
+	ts := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	_, unitA := newMockAPI(t, mockapi.Page("1-a", false, mockapi.Alert(ts, "a.example.net", "c2_communication")))
+	_, unitB := newMockAPI(t, mockapi.Page("1-b", false, mockapi.Alert(ts, "b.example.net", "c2_communication")))
+
+	dir := filepath.Join(t.TempDir(), "registry")
+	bt := newTestBeatWith(t, New, unitA, map[string]interface{}{
+		"registry_file": filepath.Join(dir, "checkpoint.yaml"),
+		"inputs": []map[string]interface{}{
+			{"name": "unit-a", "api_key": "key-a"},
+			{"name": "unit-b", "api_key": "key-b", "api_url": unitB},
+		},
+	})
+
+	// Registry directory is replaced by a file, so writes fail.
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, ioutil.WriteFile(dir, nil, 0600))
+
+	p := &fakePipeline{autoACK: true}
+	done := runBeat(bt, p)
+	require.Eventually(t, func() bool { return len(p.published()) == 2 },
+		5*time.Second, 5*time.Millisecond)
+	bt.Stop()
+	require.NoError(t, <-done)
+
+	// Failed writes are reported with the inputs keeping their cursors in
+	// the registry.
+	inputs := map[interface{}]bool{}
+	for _, e := range logp.ObserverLogs().FilterMessageSnippet("Failed to write registry").All() {
+		fields := e.ContextMap()
+		assert.Equal(t, filepath.Join(dir, "checkpoint.yaml"), fields["registry"])
+		inputs[fields["input"]] = true
+	}
+	assert.Equal(t, map[interface{}]bool{"unit-a": true, "unit-b": true}, inputs)
+}
@@ -0,0 +1,295 @@
+package beater
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/testing"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc"
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+// Exit codes of the API test.
+const (
+	APITestOK           = 0 // API is reachable and accepts the api key.
+	APITestConfigError  = 1 // Beat config is invalid.
+	APITestUnreachable  = 2 // DNS lookup, connection or TLS handshake failed.
+	APITestUnauthorized = 3 // API rejected the api key.
+	APITestAPIError     = 4 // API returned other error or invalid response.
+)
+
+// TestAPI checks that alerts can be fetched with the beat config and reports
+// each step to d. The alerts request uses the stored checkpoint, which is
+// only read. Every input is checked, the exit code of the first failing
+// one is returned.
+func TestAPI(d testing.Driver, cfg *common.Config) int {
+	c, err := unpackConfig(cfg)
+	if err != nil {
+		d.Error("read config", err)
+		return APITestConfigError
+	}
+
+	code := APITestOK
+	for _, ic := range c.InputList() {
+		if ic.Type == config.InputFile || ic.Type == config.InputWebhook {
+			continue
+		}
+		ic := ic
+		name := "alphasoc api: " + ic.APIURL
+		if ic.Name != "" {
+			name = "input " + ic.Name + ": " + ic.APIURL
+		}
+
+		d.Run(name, func(d testing.Driver) {
+			if res := testAPI(d, inputConfig(c, ic), ic.Cursor()); code == APITestOK {
+				code = res
+			}
+		})
+	}
+	return code
+}
+
+func testAPI(d testing.Driver, c config.Config, cursor string) int {
+	u, err := url.Parse(c.APIURL)
+	if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("unsupported api url scheme %q", u.Scheme)
+	}
+	d.Error("parse url", err)
+	if err != nil {
+		return APITestConfigError
+	}
+
+	if c.APIKey == "" {
+		d.Error("api key", errors.New("api_key is not set"))
+		return APITestConfigError
+	}
+
+	rt, err := newTransport(c.HTTP, u.Hostname())
+	d.Error("http settings", err)
+	if err != nil {
+		return APITestConfigError
+	}
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if timeout := c.HTTP.RequestTimeLimit(); timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	var proxy *url.URL
+	if rt.Proxy != nil {
+		proxy, err = rt.Proxy(&http.Request{URL: u})
+	}
+	switch {
+	case err != nil:
+		d.Error("proxy", err)
+		return APITestConfigError
+	case proxy != nil:
+		// Direct connection may be impossible, it is checked by the request.
+		d.Info("proxy", proxy.Redacted())
+	default:
+		if code := testConnection(ctx, d, u, rt, c.HTTP.ConnectTimeout); code != APITestOK {
+			return code
+		}
+	}
+
+	code := APITestOK
+	d.Run("alerts request", func(d testing.Driver) {
+		code = testAlertsRequest(ctx, d, c, cursor, rt)
+	})
+	return code
+}
+
+// testConnection resolves the API host and connects to it directly.
+func testConnection(ctx context.Context, d testing.Driver, u *url.URL, rt *http.Transport, timeout time.Duration) int {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	code := APITestOK
+	d.Run("connection", func(d testing.Driver) {
+		addresses, err := net.DefaultResolver.LookupHost(ctx, u.Hostname())
+		d.Error("dns lookup", err)
+		if err != nil {
+			code = APITestUnreachable
+			return
+		}
+		d.Info("addresses", strings.Join(addresses, ", "))
+
+		var conn net.Conn
+		dialer := &net.Dialer{Timeout: timeout}
+		for _, addr := range addresses {
+			conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+			if err == nil {
+				break
+			}
+		}
+		d.Error("dial up", err)
+		if err != nil {
+			code = APITestUnreachable
+			return
+		}
+		defer conn.Close()
+
+		if u.Scheme != "https" {
+			d.Warn("TLS", "secure connection disabled")
+			return
+		}
+
+		tlsConn := tls.Client(conn, rt.TLSClientConfig.Clone())
+		err = tlsConn.HandshakeContext(ctx)
+		d.Error("TLS handshake", err)
+		if err != nil {
+			code = APITestUnreachable
+			return
+		}
+
+		state := tlsConn.ConnectionState()
+		d.Info("TLS version", tlsVersion(state.Version))
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			d.Info("certificate", fmt.Sprintf("%s, issued by %s, valid until %s",
+				cert.Subject.CommonName, cert.Issuer.CommonName, cert.NotAfter.UTC().Format(time.RFC3339)))
+		}
+	})
+	return code
+}
+
+// testAlertsRequest fetches a page of alerts following the stored cursor.
+func testAlertsRequest(ctx context.Context, d testing.Driver, c config.Config, cursor string,
+	rt http.RoundTripper) int {
+	q := alphasoc.Query{}
+	if c.RegistryFile != "" {
+		// The registry is read without opening its store, which could
+		// migrate or rotate it.
+		ps, err := checkpoint.ReadState(c.Registry, c.RegistryFile)
+		if err != nil {
+			d.Warn("checkpoint", err.Error())
+		} else if ps != nil {
+			s := ps.Cursors[cursor]
+			q = alphasoc.Query{Follow: s.Follow, After: s.LastAlertTime}
+		}
+	}
+
+	rec := &responseRecorder{rt: rt}
+	api, err := alphasoc.New(c.APIURL, c.APIKey, alphasoc.WithTransport(rec))
+	if err != nil {
+		d.Error("create client", err)
+		return APITestConfigError
+	}
+
+	body, err := api.Query(ctx, q)
+	if resp := rec.last(); resp != nil {
+		d.Info("status", resp.Status)
+		reportRateLimit(d, resp.Header)
+	}
+
+	var (
+		authErr   *alphasoc.AuthError
+		followErr *alphasoc.InvalidFollowError
+		urlErr    *url.Error
+	)
+	switch {
+	case errors.As(err, &authErr):
+		d.Error("api key", err)
+		return APITestUnauthorized
+	case errors.As(err, &followErr):
+		d.Error("api key", nil)
+		d.Error("follow token", err)
+		return APITestAPIError
+	case errors.As(err, &urlErr):
+		d.Error("request", err)
+		return APITestUnreachable
+	case err != nil:
+		d.Error("request", err)
+		return APITestAPIError
+	}
+
+	d.Error("api key", nil)
+	n := 0
+	if body.Alerts != nil {
+		n = len(*body.Alerts)
+	}
+	d.Info("alerts", fmt.Sprintf("%d (more: %t)", n, body.More))
+	return APITestOK
+}
+
+// reportRateLimit reports rate limit headers of the response.
+func reportRateLimit(d testing.Driver, h http.Header) {
+	var names []string
+	for name := range h {
+		lower := strings.ToLower(name)
+		if strings.Contains(lower, "ratelimit") || lower == "retry-after" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		d.Info("rate limit", "no rate limit headers")
+		return
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		d.Info(name, h.Get(name))
+	}
+}
+
+func tlsVersion(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLSv1.0"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return fmt.Sprintf("unknown (0x%04x)", v)
+	}
+}
+
+// responseRecorder is a round tripper keeping the last response, so its
+// status and headers can be reported.
+type responseRecorder struct {
+	rt   http.RoundTripper
+	mu   sync.Mutex
+	resp *http.Response
+}
+
+func (r *responseRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.rt.RoundTrip(req)
+	if err == nil {
+		r.mu.Lock()
+		r.resp = resp
+		r.mu.Unlock()
+	}
+	return resp, err
+}
+
+func (r *responseRecorder) last() *http.Response {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.resp
+}
@@ -0,0 +1,160 @@
+package beater
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	libtesting "github.com/elastic/beats/v7/libbeat/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc/mockapi"
+)
+
+// runAPITest runs the API test with the given settings and returns its exit
+// code and report.
+func runAPITest(t *testing.T, settings map[string]interface{}) (int, string) {
+	cfg, err := common.NewConfigFrom(settings)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	d := libtesting.NewConsoleDriverWithKiller(&out, func() { t.Fatal("unexpected fatal error") })
+	return TestAPI(d, cfg), out.String()
+}
+
+func TestTestAPI(t *testing.T) {
+	registry := filepath.Join(t.TempDir(), "checkpoint.yaml")
+	data := []byte("update_time: 2021-05-01T10:00:00Z\nfollow: 2-b\n")
+	require.NoError(t, ioutil.WriteFile(registry, data, 0600))
+
+	page := alertPage("3-c")
+	page.Header = map[string]string{"X-RateLimit-Limit": "10", "X-RateLimit-Remaining": "9"}
+	api, apiURL := newMockAPI(t, page)
+
+	code, out := runAPITest(t, map[string]interface{}{
+		"api_url":       apiURL,
+		"api_key":       "key",
+		"registry_file": registry,
+	})
+	assert.Equal(t, APITestOK, code, out)
+	assert.Contains(t, out, "dial up... OK")
+	assert.Contains(t, out, "TLS... WARN secure connection disabled")
+	assert.Contains(t, out, "status: 200 OK")
+	assert.Contains(t, out, "X-Ratelimit-Remaining: 9")
+	assert.Contains(t, out, "alerts: 1 (more: true)")
+
+	// Request follows the stored checkpoint without changing it.
+	assert.Equal(t, []string{"2-b"}, follows(api))
+	contents, err := ioutil.ReadFile(registry)
+	require.NoError(t, err)
+	assert.Equal(t, data, contents)
+}
+
+func TestTestAPI_Failures(t *testing.T) {
+	closed := httptest.NewServer(mockapi.New())
+	closed.Close()
+
+	registry := filepath.Join(t.TempDir(), "checkpoint.yaml")
+	require.NoError(t, ioutil.WriteFile(registry, []byte("follow: 2-b\n"), 0600))
+
+	tests := []struct {
+		name     string
+		response mockapi.Response
+		settings map[string]interface{}
+		code     int
+		report   string
+	}{
+		{
+			name:     "missing api key",
+			settings: map[string]interface{}{"api_key": ""},
+			code:     APITestConfigError,
+			report:   "api key... ERROR api_key is not set",
+		},
+		{
+			name:     "unreachable",
+			settings: map[string]interface{}{"api_url": closed.URL},
+			code:     APITestUnreachable,
+			report:   "dial up... ERROR",
+		},
+		{
+			name:     "api key rejected",
+			response: mockapi.ClientError(http.StatusUnauthorized),
+			code:     APITestUnauthorized,
+			report:   "api key... ERROR",
+		},
+		{
+			name:     "rate limited",
+			response: mockapi.RateLimited(30 * time.Second),
+			code:     APITestAPIError,
+			report:   "Retry-After: 30",
+		},
+		{
+			name:     "server error",
+			response: mockapi.ServerError(http.StatusServiceUnavailable),
+			code:     APITestAPIError,
+			report:   "status: 503 Service Unavailable",
+		},
+		{
+			name:     "invalid follow",
+			response: mockapi.InvalidFollow(),
+			settings: map[string]interface{}{"registry_file": registry},
+			code:     APITestAPIError,
+			report:   "follow token... ERROR",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, apiURL := newMockAPI(t, tt.response)
+
+			settings := map[string]interface{}{"api_url": apiURL, "api_key": "key"}
+			for k, v := range tt.settings {
+				settings[k] = v
+			}
+
+			code, out := runAPITest(t, settings)
+			assert.Equal(t, tt.code, code, out)
+			assert.Contains(t, out, tt.report)
+		})
+	}
+}
+
+func TestTestAPI_TLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, 2, x509.ExtKeyUsageServerAuth)
+	pair, err := tls.X509KeyPair(serverCert, serverKey)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(mockapi.New())
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	t.Run("trusted CA", func(t *testing.T) {
+		code, out := runAPITest(t, map[string]interface{}{
+			"api_url":                          srv.URL,
+			"api_key":                          "key",
+			"http.ssl.certificate_authorities": []string{writeTempFile(t, "ca.pem", ca.pem)},
+		})
+		assert.Equal(t, APITestOK, code, out)
+		assert.Contains(t, out, "TLS handshake... OK")
+		assert.Contains(t, out, "certificate: localhost, issued by alphasocbeat test CA")
+	})
+
+	t.Run("untrusted CA", func(t *testing.T) {
+		code, out := runAPITest(t, map[string]interface{}{
+			"api_url": srv.URL,
+			"api_key": "key",
+		})
+		assert.Equal(t, APITestUnreachable, code, out)
+		assert.Contains(t, out, "TLS handshake... ERROR")
+	})
+}
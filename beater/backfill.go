@@ -0,0 +1,152 @@
+package beater
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+)
+
+// backfill is time window of historical alerts to fetch.
+type backfill struct {
+	from time.Time
+	to   time.Time
+
+	// name of the input, printed with progress.
+	name string
+
+	pages  int
+	alerts int
+	out    io.Writer
+}
+
+// NewBackfill returns creator of beat fetching alerts from the time window
+// between from and to, and stopping when all of them are published. Position
+// in the window is kept in registryFile, so backfill can be resumed, and the
+// registry files of the running beat are left untouched. All inputs keep
+// their cursors in registryFile.
+func NewBackfill(from, to time.Time, registryFile string) beat.Creator {
+	return func(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
+		if !from.Before(to) {
+			return nil, fmt.Errorf("backfill window start %s is not before its end %s",
+				from.Format(time.RFC3339), to.Format(time.RFC3339))
+		}
+
+		c, err := unpackConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := useMappingVersion(b, c); err != nil {
+			return nil, err
+		}
+		c.RegistryFile = registryFile
+		for i := range c.Inputs {
+			c.Inputs[i].RegistryFile = ""
+		}
+
+		bt, err := newBeat(c)
+		if err != nil {
+			return nil, err
+		}
+		// File and webhook inputs have no history to fetch.
+		var inputs []*input
+		for _, in := range bt.inputs {
+			if in.api != nil {
+				inputs = append(inputs, in)
+			}
+		}
+		bt.inputs = inputs
+
+		for _, in := range bt.inputs {
+			in.backfill = &backfill{from: from, to: to, name: in.name, out: os.Stdout}
+
+			if s := in.cursor.State(); s.Follow != "" {
+				in.log.Infof("Resuming backfill from %s", in.cursor.Location())
+			}
+		}
+
+		return bt, nil
+	}
+}
+
+// done reports whether the backfill resumed from s is complete.
+func (bf *backfill) done(s checkpoint.State) bool {
+	return !s.LastAlertTime.Before(bf.to)
+}
+
+// clip removes alerts at or after the end of the window from the page, in
+// case API returns them, and reports whether the page reached the end.
+// Alerts after the window belong to the running beat.
+func (bf *backfill) clip(body *alertResponse) bool {
+	if body.Alerts == nil {
+		return false
+	}
+
+	reached := false
+	alerts := (*body.Alerts)[:0]
+	for i := range *body.Alerts {
+		a := (*body.Alerts)[i]
+		if t, ok := alertTime(&a); ok && !t.Before(bf.to) {
+			reached = true
+			continue
+		}
+		alerts = append(alerts, a)
+	}
+	*body.Alerts = alerts
+	return reached
+}
+
+// progress reports fetched page of alerts.
+func (bf *backfill) progress(body *alertResponse, s checkpoint.State) {
+	bf.pages++
+	if body.Alerts != nil {
+		bf.alerts += len(*body.Alerts)
+	}
+
+	if s.LastAlertTime.IsZero() {
+		fmt.Fprintf(bf.out, "%s: %d pages, %d alerts\n", bf.label(), bf.pages, bf.alerts)
+		return
+	}
+
+	done := s.LastAlertTime.Sub(bf.from).Seconds() / bf.to.Sub(bf.from).Seconds() * 100
+	if done < 0 {
+		done = 0
+	} else if done > 100 {
+		done = 100
+	}
+	fmt.Fprintf(bf.out, "%s: %d pages, %d alerts, at %s (%.0f%%)\n",
+		bf.label(), bf.pages, bf.alerts, s.LastAlertTime.Format(time.RFC3339), done)
+}
+
+// finish waits until all fetched alerts are acknowledged by the output and
+// the position in the window is written to the registry.
+func (bf *backfill) finish(ctx context.Context, tracker *pageTracker, cursor *checkpoint.Cursor) error {
+	select {
+	case <-tracker.idle():
+	case <-ctx.Done():
+		return nil
+	}
+	if err := cursor.Flush(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("writing backfill position to %s: %w", cursor.Location(), err)
+	}
+
+	fmt.Fprintf(bf.out, "%s complete: %d pages, %d alerts\n", bf.label(), bf.pages, bf.alerts)
+	return nil
+}
+
+// label returns prefix of the progress messages.
+func (bf *backfill) label() string {
+	if bf.name == "" {
+		return "Backfill"
+	}
+	return "Backfill " + bf.name
+}
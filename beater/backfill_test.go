@@ -0,0 +1,146 @@
+package beater
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc/mockapi"
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+)
+
+func TestBackfill(t *testing.T) {
+	from := time.Date(2021, time.April, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2021, time.April, 8, 0, 0, 0, 0, time.UTC)
+
+	api, apiURL := newMockAPI(t,
+		alertPage("1-a"),
+		alertPage("2-b"),
+		mockapi.Page("3-c", false),
+	)
+
+	dir := t.TempDir()
+	liveRegistry := filepath.Join(dir, "checkpoint.yaml")
+	registry := filepath.Join(dir, "backfill.yaml")
+
+	bt := newTestBeatWith(t, NewBackfill(from, to, registry), apiURL, map[string]interface{}{
+		"registry_file": liveRegistry,
+	})
+	out := &bytes.Buffer{}
+	bt.inputs[0].backfill.out = out
+
+	p := &fakePipeline{autoACK: true}
+	select {
+	case err := <-runBeat(bt, p):
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("backfill did not finish")
+	}
+
+	assert.Len(t, p.published(), 2)
+	assert.Equal(t, []mockapi.Request{
+		{After: "2021-04-01T00:00:00Z", Before: "2021-04-08T00:00:00Z"},
+		{Follow: "1-a", Before: "2021-04-08T00:00:00Z"},
+		{Follow: "2-b", Before: "2021-04-08T00:00:00Z"},
+	}, queries(api))
+
+	// Live registry is not touched, position in the window is persisted.
+	_, err := os.Stat(liveRegistry)
+	assert.True(t, os.IsNotExist(err))
+
+	cp, err := checkpoint.NewCheckpoint(registry, 1, time.Minute)
+	require.NoError(t, err)
+	defer cp.Shutdown()
+	s := cp.State(checkpoint.DefaultCursor)
+	assert.Equal(t, "3-c", s.Follow)
+	assert.Equal(t, int64(3), s.Pages)
+	assert.Equal(t, int64(2), s.Events)
+	assert.False(t, s.LastSuccess.IsZero())
+
+	assert.Contains(t, out.String(), "Backfill: 1 pages, 1 alerts, at 2021-04-07T09:55:37Z (92%)")
+	assert.Contains(t, out.String(), "Backfill complete: 3 pages, 2 alerts")
+}
+
+func TestBackfill_Resume(t *testing.T) {
+	from := time.Date(2021, time.April, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2021, time.April, 8, 0, 0, 0, 0, time.UTC)
+	registry := filepath.Join(t.TempDir(), "backfill.yaml")
+
+	// Registry left by interrupted backfill.
+	require.NoError(t, ioutil.WriteFile(registry, []byte("follow: 2-b\n"), 0600))
+
+	api, apiURL := newMockAPI(t, mockapi.Page("3-c", false))
+
+	bt := newTestBeatWith(t, NewBackfill(from, to, registry), apiURL, nil)
+	bt.inputs[0].backfill.out = &bytes.Buffer{}
+
+	select {
+	case err := <-runBeat(bt, &fakePipeline{autoACK: true}):
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("backfill did not finish")
+	}
+
+	assert.Equal(t, []mockapi.Request{{Follow: "2-b", Before: "2021-04-08T00:00:00Z"}}, queries(api))
+}
+
+func TestBackfill_WindowEnd(t *testing.T) {
+	from := time.Date(2021, time.May, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	api, apiURL := newMockAPI(t,
+		mockapi.Page("1-a", true, mockapi.Alert(from.Add(10*time.Minute), "a.example.net", "c2_communication")),
+		mockapi.Page("2-b", true,
+			mockapi.Alert(to.Add(-time.Minute), "b.example.net", "c2_communication"),
+			mockapi.Alert(to, "live-1.example.net", "c2_communication"),
+			mockapi.Alert(to.Add(time.Minute), "live-2.example.net", "c2_communication")),
+		mockapi.Page("3-c", true, mockapi.Alert(to.Add(2*time.Minute), "live-3.example.net", "c2_communication")),
+	)
+	registry := filepath.Join(t.TempDir(), "backfill.yaml")
+
+	run := func() *fakePipeline {
+		bt := newTestBeatWith(t, NewBackfill(from, to, registry), apiURL, nil)
+		bt.inputs[0].backfill.out = &bytes.Buffer{}
+		p := &fakePipeline{autoACK: true}
+		select {
+		case err := <-runBeat(bt, p):
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("backfill did not finish")
+		}
+		return p
+	}
+
+	// Alerts after the window are dropped and the page reaching it ends
+	// backfill, though API has more alerts.
+	p := run()
+	assert.Equal(t, []interface{}{"a.example.net", "b.example.net"}, publishedQueries(p))
+	assert.Equal(t, 1, api.Pending())
+	for _, r := range api.Requests() {
+		assert.Equal(t, "2021-05-01T01:00:00Z", r.Before)
+	}
+
+	cp, err := checkpoint.NewCheckpoint(registry, 1, time.Minute)
+	require.NoError(t, err)
+	s := cp.State(checkpoint.DefaultCursor)
+	cp.Shutdown()
+	assert.Equal(t, "2-b", s.Follow)
+	assert.Equal(t, to.Add(-time.Minute), s.LastAlertTime)
+
+	// Completed backfill run again does not publish live alerts.
+	p = run()
+	assert.Empty(t, p.published())
+	assert.Equal(t, 0, api.Pending())
+	assert.Equal(t, []string{"", "1-a", "2-b"}, follows(api))
+}
+
+func TestBackfill_InvalidWindow(t *testing.T) {
+	from := time.Date(2021, time.April, 8, 0, 0, 0, 0, time.UTC)
+	_, err := NewBackfill(from, from, "backfill.yaml")(nil, nil)
+	assert.Error(t, err)
+}
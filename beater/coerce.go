@@ -0,0 +1,182 @@
+package beater
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+)
+
+// valueType is type attribute values are normalised to, matching the type of
+// the index field they are mapped to.
+type valueType int
+
+// Types of values of index fields.
+const (
+	// intValue is integer, e.g. port or byte count, published as int64.
+	intValue valueType = iota + 1
+	// floatValue is number published as float64.
+	floatValue
+	// ipValue is IPv4 or IPv6 address in canonical text form.
+	ipValue
+	// macValue is MAC address in the notation suggested by ECS, uppercase
+	// hexadecimal octets separated by hyphens.
+	macValue
+	// durationValue is duration given in seconds, published in nanoseconds
+	// as ECS event.duration expects.
+	durationValue
+	// dateValue is RFC3339 time published as time.Time.
+	dateValue
+)
+
+var errNotNumber = errors.New("not a number")
+
+// coerce returns v normalised to the type t.
+func coerce(t valueType, v interface{}) (interface{}, error) {
+	switch t {
+	case intValue:
+		f, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if f != math.Trunc(f) || math.Abs(f) >= 1<<63 {
+			return nil, fmt.Errorf("%v is not an integer", f)
+		}
+		return int64(f), nil
+	case floatValue:
+		return toFloat(v)
+	case ipValue:
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.New("not a string")
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		return ip.String(), nil
+	case macValue:
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.New("not a string")
+		}
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return nil, err
+		}
+		return strings.ToUpper(strings.ReplaceAll(mac.String(), ":", "-")), nil
+	case durationValue:
+		f, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if f < 0 || f*float64(time.Second) >= 1<<63 {
+			return nil, fmt.Errorf("duration %v seconds out of range", f)
+		}
+		return int64(math.Round(f * float64(time.Second))), nil
+	case dateValue:
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.New("not a string")
+		}
+		ts, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		return ts.UTC(), nil
+	}
+	return v, nil
+}
+
+// toFloat returns number held by v, which is a number decoded from json, or
+// a string holding one.
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case int32:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case uint32:
+		return float64(n), nil
+	case json.Number:
+		return n.Float64()
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		if err != nil {
+			return 0, errNotNumber
+		}
+		return f, nil
+	}
+	return 0, errNotNumber
+}
+
+// coercionMetrics count attribute values of alerts, per pipeline, which were
+// dropped because they could not be normalised to the type of their field,
+// e.g. alphasocbeat.coercion_failures.ip.
+var coercionMetrics = monitoring.Default.NewRegistry("alphasocbeat.coercion_failures")
+
+// coercion normalises attribute values of alerts to the types of their
+// fields, counting failures and logging the first failure of every field.
+var coercion = &fieldCoercion{
+	counters: map[string]*monitoring.Int{},
+	seen:     map[string]bool{},
+	log:      logp.NewLogger("alphasocbeat"),
+}
+
+// fieldCoercion normalises values of the fields in fieldValueTypes.
+type fieldCoercion struct {
+	mu       sync.Mutex
+	counters map[string]*monitoring.Int
+	seen     map[string]bool
+	log      *logp.Logger
+}
+
+// value returns v normalised to the type of the field of alert of the
+// pipeline. It returns false if v cannot be normalised, then the field is
+// left out of the event, as the index would reject the document.
+func (fc *fieldCoercion) value(pipeline, field string, v interface{}) (interface{}, bool) {
+	t, ok := fieldValueTypes[field]
+	if !ok {
+		return v, true
+	}
+	nv, err := coerce(t, v)
+	if err == nil {
+		return nv, true
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	counter, ok := fc.counters[pipeline]
+	if !ok {
+		counter = monitoring.NewInt(coercionMetrics, pipeline)
+		fc.counters[pipeline] = counter
+	}
+	counter.Inc()
+
+	if !fc.seen[pipeline+"/"+field] {
+		fc.seen[pipeline+"/"+field] = true
+		fc.log.Warnw("Alerts have value not matching the type of its field, the field is left out",
+			"pipeline", pipeline, "field", field, "value", v, logp.Error(err))
+	} else {
+		fc.log.Debugw("Dropped value not matching the type of its field",
+			"pipeline", pipeline, "field", field, "value", v, logp.Error(err))
+	}
+	return nil, false
+}
@@ -0,0 +1,117 @@
+package beater
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+func TestCoerce(t *testing.T) {
+	tests := []struct {
+		name string
+		t    valueType
+		in   interface{}
+		want interface{}
+		err  bool
+	}{
+		{"int from float", intValue, float64(8009), int64(8009), false},
+		{"int from int", intValue, 52065, int64(52065), false},
+		{"int from string", intValue, " 443", int64(443), false},
+		{"int from json number", intValue, json.Number("27307"), int64(27307), false},
+		{"int fraction", intValue, 1.5, nil, true},
+		{"int not number", intValue, "https", nil, true},
+		{"int out of range", intValue, 1e19, nil, true},
+		{"float from int", floatValue, 3, float64(3), false},
+		{"float from string", floatValue, "0.8", 0.8, false},
+		{"float not number", floatValue, true, nil, true},
+		{"ipv4", ipValue, "10.14.1.39", "10.14.1.39", false},
+		{"ipv6", ipValue, "2001:DB8:0:0::1", "2001:db8::1", false},
+		{"ipv4 mapped ipv6", ipValue, "::ffff:10.14.1.39", "10.14.1.39", false},
+		{"invalid ip", ipValue, "10.14.1", nil, true},
+		{"ip not string", ipValue, 10, nil, true},
+		{"mac colons", macValue, "da:23:68:50:c4:77", "DA-23-68-50-C4-77", false},
+		{"mac hyphens", macValue, "DA-23-68-50-C4-77", "DA-23-68-50-C4-77", false},
+		{"mac dots", macValue, "da23.6850.c477", "DA-23-68-50-C4-77", false},
+		{"invalid mac", macValue, "da:23:68", nil, true},
+		{"duration", durationValue, 2.48475075448, int64(2484750754), false},
+		{"duration from int", durationValue, 3, int64(3 * time.Second), false},
+		{"negative duration", durationValue, -1.0, nil, true},
+		{"date", dateValue, "2021-03-30T00:34:02Z", time.Date(2021, time.March, 30, 0, 34, 2, 0, time.UTC), false},
+		{"date with offset", dateValue, "2021-03-30T02:34:02.5+02:00", time.Date(2021, time.March, 30, 0, 34, 2, 5e8, time.UTC), false},
+		{"invalid date", dateValue, "2021-03-30 00:34:02", nil, true},
+		{"date not string", dateValue, 1617064442, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := coerce(tt.t, tt.in)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// coercionFailures returns number of values of alerts of the pipeline
+// dropped because they did not match the type of their field.
+func coercionFailures(pipeline string) int64 {
+	if v, ok := coercionMetrics.Get(pipeline).(*monitoring.Int); ok {
+		return v.Get()
+	}
+	return 0
+}
+
+func TestBeatEvents_CoercionFailures(t *testing.T) {
+	response := `{
+		"alerts": [{
+			"eventType": "ip",
+			"event": {
+				"ts": "2021-04-07T09:57:17Z",
+				"srcIP": "10.100.92.3",
+				"srcPort": "ephemeral",
+				"destIP": "not-an-ip",
+				"destPort": "8009",
+				"bytesIn": 27307,
+				"rtt": "0.25"
+			},
+			"threats": ["c2_communication", "unusual_port"]
+		}]
+	}`
+	body := &alertResponse{}
+	require.NoError(t, json.Unmarshal([]byte(response), body))
+	failures := coercionFailures("ip")
+
+	c := newConverter(nil)
+	c.configure(config.Config{
+		MappingVersion: config.MappingVersionLegacy,
+		Mappings: map[string]config.MappingConfig{
+			"ip": {Event: map[string]string{"rtt": "event.risk_score"}},
+		},
+	})
+	events := c.beatEvents(body)
+	require.Len(t, events, 2)
+
+	for _, e := range events {
+		assert.Equal(t, "10.100.92.3", e.Fields["source.ip"])
+		assert.Equal(t, int64(8009), e.Fields["destination.port"])
+		assert.Equal(t, int64(27307), e.Fields["destination.bytes"])
+		assert.Equal(t, 0.25, e.Fields["event.risk_score"])
+		assert.NotContains(t, e.Fields, "source.port")
+		assert.NotContains(t, e.Fields, "destination.ip")
+
+		// The raw copy keeps the value as received.
+		assert.Equal(t, "not-an-ip", e.Fields["alphasoc.event.dest.ip_raw"])
+	}
+
+	// Values are counted once per alert, not per threat.
+	assert.Equal(t, failures+2, coercionFailures("ip"))
+}
@@ -0,0 +1,145 @@
+package beater
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"gopkg.in/yaml.v2"
+
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+// legacyFieldAliases returns map of the legacy fields, which are not set
+// with mapping_version 2, with the ECS fields they are aliases of.
+func legacyFieldAliases() map[string]string {
+	aliases := make(map[string]string, len(ecsEventFields)+len(rawFieldAliases))
+	for k, ecsField := range ecsEventFields {
+		if legacy, ok := eventFields[k]; ok {
+			aliases[legacy] = ecsField
+		}
+	}
+	for legacy, ecsField := range rawFieldAliases {
+		aliases[legacy] = ecsField
+	}
+	return aliases
+}
+
+// useMappingVersion adjusts the fields of the index template and index
+// pattern of b to the mapping version selected by c.
+func useMappingVersion(b *beat.Beat, c config.Config) error {
+	if c.MappingVersion != config.MappingVersionECS || len(b.Fields) == 0 {
+		return nil
+	}
+
+	fields, err := aliasLegacyFields(b.Fields, legacyFieldAliases())
+	if err != nil {
+		return fmt.Errorf("creating fields of mapping_version %d: %w", c.MappingVersion, err)
+	}
+	b.Fields = fields
+	return nil
+}
+
+// aliasLegacyFields returns fields.yml data with the fields given as keys of
+// aliases replaced by aliases of the fields given as values.
+func aliasLegacyFields(data []byte, aliases map[string]string) ([]byte, error) {
+	var keys []yaml.MapSlice
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if fields, ok := yamlValue(key, "fields").([]interface{}); ok {
+			aliasFields(fields, "", aliases)
+		}
+	}
+	return yaml.Marshal(keys)
+}
+
+// aliasFields replaces the fields of the list with aliases. Names of the
+// fields are prefixed with prefix.
+func aliasFields(fields []interface{}, prefix string, aliases map[string]string) {
+	for i, f := range fields {
+		field, ok := f.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+		name, _ := yamlValue(field, "name").(string)
+
+		if path, ok := aliases[prefix+name]; ok {
+			fields[i] = yaml.MapSlice{
+				{Key: "name", Value: name},
+				{Key: "type", Value: "alias"},
+				{Key: "path", Value: path},
+			}
+			continue
+		}
+		if sub, ok := yamlValue(field, "fields").([]interface{}); ok {
+			aliasFields(sub, prefix+name+".", aliases)
+		}
+	}
+}
+
+// yamlValue returns value of the key of m, or nil.
+func yamlValue(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// mappingMigrationNote is the text of the migration note, with quotes
+// standing for backquotes, followed by the table of legacy fields.
+const mappingMigrationNote = `# Migrating to mapping_version 2
+
+<!-- Generated by "alphasocbeat mapping migration-note", do not edit. -->
+
+With 'mapping_version: 2' protocol data of alerts is published in ECS fields
+instead of the custom 'alphasoc.event.*' fields listed below. The index
+template of mapping version 2 defines the custom fields as aliases of the ECS
+fields, so dashboards and searches using them keep working on new indices,
+while old indices keep the custom fields.
+
+1. Set 'alphasocbeat.mapping_version: 2'.
+2. Overwrite the index template and index pattern with the ones of the new
+   mapping, with 'alphasocbeat setup --index-management --dashboards' run with
+   the new setting. The beat loads the template on start only if it does not
+   exist yet. Template printed by 'alphasocbeat export template' is the
+   template of mapping version 1.
+3. Restart the beat. Alerts published to the current index are written to the
+   ECS fields, which it already defines. The new template applies from the
+   next index, e.g. after rollover.
+4. Update ingest pipelines and processors reading or writing the custom
+   fields: aliases can be searched and aggregated, but they are not part of
+   the document source and cannot be written.
+
+'alphasoc.destination' is set by the beat instead of being copied from the
+event fields by the index template.
+
+| Field of mapping version 1 | ECS field of mapping version 2 |
+|---|---|
+`
+
+// WriteMappingMigrationNote writes Markdown note describing migration of
+// dashboards, searches and ingest pipelines from mapping_version 1 to 2.
+func WriteMappingMigrationNote(w io.Writer) error {
+	aliases := legacyFieldAliases()
+	legacy := make([]string, 0, len(aliases))
+	for k := range aliases {
+		legacy = append(legacy, k)
+	}
+	sort.Strings(legacy)
+
+	var b strings.Builder
+	b.WriteString(strings.ReplaceAll(mappingMigrationNote, "'", "`"))
+	for _, k := range legacy {
+		fmt.Fprintf(&b, "| `%s` | `%s` |\n", k, aliases[k])
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
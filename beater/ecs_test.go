@@ -0,0 +1,49 @@
+package beater
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+func TestUseMappingVersion(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("..", "fields.yml"))
+	require.NoError(t, err)
+
+	b := &beat.Beat{Fields: data}
+	require.NoError(t, useMappingVersion(b, config.Config{MappingVersion: config.MappingVersionLegacy}))
+	assert.Equal(t, data, b.Fields)
+
+	require.NoError(t, useMappingVersion(b, config.Config{MappingVersion: config.MappingVersionECS}))
+	before, err := fieldDefinitions(data)
+	require.NoError(t, err)
+	after, err := fieldDefinitions(b.Fields)
+	require.NoError(t, err)
+	assert.Len(t, after, len(before))
+
+	for legacy, ecsField := range legacyFieldAliases() {
+		assert.NotEqual(t, "alias", yamlValue(before[legacy], "type"), legacy)
+		assert.Equal(t, "alias", yamlValue(after[legacy], "type"), legacy)
+		assert.Equal(t, ecsField, yamlValue(after[legacy], "path"), legacy)
+
+		require.Contains(t, after, ecsField, "ECS field of %s", legacy)
+		assert.NotEqual(t, "alias", yamlValue(after[ecsField], "type"), ecsField)
+	}
+	assert.Equal(t, "date", yamlValue(after["alphasoc.event.ts"], "type"))
+}
+
+func TestWriteMappingMigrationNote(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteMappingMigrationNote(&buf))
+	assert.Contains(t, buf.String(), "| `alphasoc.event.query` | `dns.question.name` |\n")
+
+	// The note kept in docs is up to date.
+	assertGolden(t, filepath.Join("..", "docs", "mapping-migration.md"), buf.Bytes())
+}
@@ -0,0 +1,201 @@
+package beater
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"gopkg.in/yaml.v2"
+
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+// reservedFields are fields set by the beat, attributes cannot be mapped to
+// them or to fields under them.
+var reservedFields = []string{
+	"@timestamp",
+	"alphasoc.destination",
+	"alphasoc.event.extra",
+	"alphasoc.event.ts",
+	"alphasoc.pipeline",
+	"alphasoc.status",
+	"alphasoc.tenant",
+	"alphasoc.threat",
+	"alphasoc.wisdom.extra",
+	"event.category",
+	"event.kind",
+	"event.original",
+	"event.severity",
+	"event.type",
+	"fields",
+	"rule",
+	"threat",
+}
+
+// checkMappings checks that the mappings of c do not map attributes to
+// fields set by the beat, or to aliases of the selected mapping version.
+func checkMappings(c config.Config) error {
+	var aliases map[string]string
+	if c.MappingVersion == config.MappingVersionECS {
+		aliases = legacyFieldAliases()
+	}
+
+	for _, t := range mappingTargets(c.Mappings) {
+		for _, reserved := range reservedFields {
+			if t.field == reserved || strings.HasPrefix(t.field, reserved+".") {
+				return fmt.Errorf("%s: field %s is set by alphasocbeat", t.setting, t.field)
+			}
+		}
+		if ecsField, ok := aliases[t.field]; ok {
+			return fmt.Errorf("%s: field %s is alias of %s with mapping_version %d",
+				t.setting, t.field, ecsField, c.MappingVersion)
+		}
+	}
+	return nil
+}
+
+// mappingTarget is a field attributes are mapped to by the mappings setting.
+type mappingTarget struct {
+	field   string
+	setting string
+}
+
+// mappingTargets returns fields attributes are mapped to, sorted by the
+// setting mapping them.
+func mappingTargets(mappings map[string]config.MappingConfig) []mappingTarget {
+	var targets []mappingTarget
+	for pipeline, m := range mappings {
+		for section, fields := range map[string]map[string]string{"event": m.Event, "wisdom": m.Wisdom} {
+			for attr, field := range fields {
+				if field == "" {
+					continue
+				}
+				targets = append(targets, mappingTarget{
+					field:   field,
+					setting: "mappings." + pipeline + "." + section + "." + attr,
+				})
+			}
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].setting < targets[j].setting })
+	return targets
+}
+
+// fieldDefinitions returns definitions of the fields in fields.yml data by
+// their full names.
+func fieldDefinitions(data []byte) (map[string]yaml.MapSlice, error) {
+	var keys []yaml.MapSlice
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+
+	defs := map[string]yaml.MapSlice{}
+	var walk func(fields []interface{}, prefix string)
+	walk = func(fields []interface{}, prefix string) {
+		for _, f := range fields {
+			field, ok := f.(yaml.MapSlice)
+			if !ok {
+				continue
+			}
+			name, _ := yamlValue(field, "name").(string)
+			defs[prefix+name] = field
+			if sub, ok := yamlValue(field, "fields").([]interface{}); ok {
+				walk(sub, prefix+name+".")
+			}
+		}
+	}
+	for _, key := range keys {
+		if fields, ok := yamlValue(key, "fields").([]interface{}); ok {
+			walk(fields, "")
+		}
+	}
+	return defs, nil
+}
+
+// objectTypes are types of fields.yml fields which can hold other fields.
+var objectTypes = map[interface{}]bool{
+	"group":     true,
+	"object":    true,
+	"nested":    true,
+	"flattened": true,
+}
+
+// WriteMappingFields writes fields.yml definitions of the fields the mappings
+// of the beat config map attributes to, which are missing in the fields of
+// b. Mapping to an object or alias field, or under a field which is not an
+// object, is reported as an error.
+func WriteMappingFields(w io.Writer, b *beat.Beat, cfg *common.Config) error {
+	c, err := unpackConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if err := useMappingVersion(b, c); err != nil {
+		return err
+	}
+	defs, err := fieldDefinitions(b.Fields)
+	if err != nil {
+		return fmt.Errorf("reading fields: %w", err)
+	}
+
+	var missing []string
+	seen := map[string]bool{}
+	for _, t := range mappingTargets(c.Mappings) {
+		if def, ok := defs[t.field]; ok {
+			switch yamlValue(def, "type") {
+			case "group", "object", "nested":
+				return fmt.Errorf("%s: field %s is an object", t.setting, t.field)
+			case "alias":
+				return fmt.Errorf("%s: field %s is alias of %s, which cannot be written",
+					t.setting, t.field, yamlValue(def, "path"))
+			}
+			continue
+		}
+		for name := range defs {
+			if strings.HasPrefix(name, t.field+".") {
+				return fmt.Errorf("%s: field %s is an object", t.setting, t.field)
+			}
+		}
+		parts := strings.Split(t.field, ".")
+		for i := 1; i < len(parts); i++ {
+			parent := strings.Join(parts[:i], ".")
+			if def, ok := defs[parent]; ok && !objectTypes[yamlValue(def, "type")] {
+				return fmt.Errorf("%s: field %s is under %s, which is not an object",
+					t.setting, t.field, parent)
+			}
+		}
+		if !seen[t.field] {
+			seen[t.field] = true
+			missing = append(missing, t.field)
+		}
+	}
+
+	if len(missing) == 0 {
+		_, err := fmt.Fprintln(w, "# All fields of the mappings are defined.")
+		return err
+	}
+
+	sort.Strings(missing)
+	fields := make([]yaml.MapSlice, len(missing))
+	for i, name := range missing {
+		fields[i] = yaml.MapSlice{
+			{Key: "name", Value: name},
+			{Key: "type", Value: "keyword"},
+		}
+	}
+	data, err := yaml.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, `# Fields of the mappings setting missing in the index template. Add them to
+# setup.template.append_fields, or to _meta/fields.yml when building the beat,
+# changing the type where the attribute is not a string.
+`); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
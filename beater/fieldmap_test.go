@@ -0,0 +1,140 @@
+package beater
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+func TestBeatEvents_Mappings(t *testing.T) {
+	body := &alertResponse{
+		Alerts: &[]eventAlert{{
+			Type: "dns",
+			Event: map[string]interface{}{
+				"ts":      "2021-04-07T09:55:37Z",
+				"srcIP":   "10.14.1.39",
+				"srcMac":  "da:23:68:50:c4:77",
+				"query":   "hsxfrfokdkojcj.net",
+				"newAttr": "new value",
+				"other":   "dropped by default",
+			},
+			Threats: []string{"c2_communication"},
+			Wisdom: map[string]interface{}{
+				"flags": []interface{}{"young_domain"},
+				"score": 0.8,
+			},
+		}},
+	}
+
+	c := newConverter(nil)
+	c.mappings = map[string]config.MappingConfig{
+		"dns": {
+			Event: map[string]string{
+				"newAttr": "alphasoc.event.new_attr",
+				"query":   "dns.question.name",
+				"srcMac":  "",
+			},
+			Wisdom: map[string]string{
+				"score": "alphasoc.wisdom.score",
+				"flags": "",
+			},
+		},
+		// Mappings of other pipelines do not apply.
+		"ip": {Event: map[string]string{"srcIP": ""}},
+	}
+	events := c.beatEvents(body)
+	require.Len(t, events, 1)
+	fields := events[0].Fields
+
+	assert.Equal(t, "new value", fields["alphasoc.event.new_attr"])
+	assert.Equal(t, "hsxfrfokdkojcj.net", fields["dns.question.name"])
+	assert.Equal(t, 0.8, fields["alphasoc.wisdom.score"])
+	assert.Equal(t, "10.14.1.39", fields["source.ip"])
+	for _, k := range []string{"alphasoc.event.query", "source.mac", "alphasoc.wisdom.flags"} {
+		assert.NotContains(t, fields, k)
+	}
+
+	// Document ID does not depend on the mappings.
+	assert.Equal(t, newConverter(nil).beatEvents(body)[0].Meta, events[0].Meta)
+}
+
+func TestCheckMappings(t *testing.T) {
+	tests := map[string]struct {
+		mappingVersion int
+		field          string
+		valid          bool
+	}{
+		"new field":            {config.MappingVersionLegacy, "alphasoc.event.new_attr", true},
+		"legacy field":         {config.MappingVersionLegacy, "alphasoc.event.query", true},
+		"legacy field alias":   {config.MappingVersionECS, "alphasoc.event.query", false},
+		"ECS field":            {config.MappingVersionECS, "dns.question.name", true},
+		"threat field":         {config.MappingVersionLegacy, "alphasoc.threat.title", false},
+		"under reserved field": {config.MappingVersionLegacy, "rule.name.extra", false},
+		"reserved prefix only": {config.MappingVersionLegacy, "rules", true},
+	}
+
+	for name, tc := range tests {
+		c := config.DefaultConfig
+		c.MappingVersion = tc.mappingVersion
+		c.Mappings = map[string]config.MappingConfig{
+			"dns": {Event: map[string]string{"attr": tc.field}},
+		}
+		err := checkMappings(c)
+		if tc.valid {
+			assert.NoError(t, err, name)
+		} else {
+			assert.Error(t, err, name)
+		}
+	}
+}
+
+func TestWriteMappingFields(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("..", "fields.yml"))
+	require.NoError(t, err)
+
+	write := func(mappings map[string]interface{}) (string, error) {
+		cfg, err := common.NewConfigFrom(map[string]interface{}{"mappings": mappings})
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		err = WriteMappingFields(&buf, &beat.Beat{Fields: data}, cfg)
+		return buf.String(), err
+	}
+
+	out, err := write(map[string]interface{}{
+		"dns": map[string]interface{}{
+			"event": map[string]interface{}{
+				"newAttr": "alphasoc.event.new_attr",
+				"query":   "dns.question.name",
+				"srcMac":  "",
+			},
+		},
+		"ip": map[string]interface{}{
+			"event":  map[string]interface{}{"newAttr": "alphasoc.event.new_attr"},
+			"wisdom": map[string]interface{}{"score": "alphasoc.wisdom.score"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "- name: alphasoc.event.new_attr\n  type: keyword\n- name: alphasoc.wisdom.score\n  type: keyword\n")
+	assert.NotContains(t, out, "dns.question.name")
+
+	out, err = write(map[string]interface{}{
+		"dns": map[string]interface{}{"event": map[string]interface{}{"query": "dns.question.name"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "# All fields of the mappings are defined.\n", out)
+
+	for _, field := range []string{"dns.question", "alphasoc.event.src.host", "source.ip.extra"} {
+		_, err := write(map[string]interface{}{
+			"dns": map[string]interface{}{"event": map[string]interface{}{"attr": field}},
+		})
+		assert.Error(t, err, field)
+	}
+}
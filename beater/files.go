@@ -0,0 +1,294 @@
+package beater
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common/file"
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+)
+
+// exportExtensions are extensions of the alert export files read by file
+// input. Files hold alerts responses or alerts, either as a single JSON
+// value or one value per line.
+var exportExtensions = map[string]bool{".json": true, ".ndjson": true, ".jsonl": true}
+
+// exportBatchSize is the maximum number of alerts published as one page.
+const exportBatchSize = 500
+
+// runFiles publishes alerts of the export files in the directory of the
+// input, checking it for new data every period, until ctx is cancelled.
+// Position in every file is kept in the cursor, so data published before
+// restart is not published again.
+func (in *input) runFiles(ctx context.Context) error {
+	state := in.cursor.State()
+	for {
+		var err error
+		state, err = in.scanFiles(ctx, state)
+		if err != nil {
+			in.log.Errorw("Reading alert export files", "path", in.path, logp.Error(err))
+		}
+		if !sleep(ctx.Done(), in.config.Period) {
+			return nil
+		}
+	}
+}
+
+// scanFiles publishes new data of the export files in name order and
+// returns the state after them. File replaced by another one with the same
+// name, detected by its identity, or truncated is read from the beginning.
+func (in *input) scanFiles(ctx context.Context, state checkpoint.State) (checkpoint.State, error) {
+	infos, err := ioutil.ReadDir(in.path)
+	if err != nil {
+		return state, err
+	}
+
+	present := map[string]bool{}
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !exportExtensions[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		present[name] = true
+
+		fs := state.Files[name]
+		id := file.GetOSState(fi).String()
+		offset := fs.Offset
+		switch {
+		case fs.ID != "" && fs.ID != id:
+			in.log.Warnf("Export file %s was replaced, it is read from the beginning", name)
+			offset = 0
+		case fi.Size() < offset:
+			in.log.Warnf("Export file %s is smaller than the read offset %d, "+
+				"it was truncated and is read again from the beginning", name, offset)
+			offset = 0
+		}
+		if fi.Size() == offset {
+			if fs.ID != id {
+				// Identity is kept also for files without new data, e.g.
+				// replaced by an empty file or read by earlier version.
+				state = state.WithFile(name, checkpoint.FileState{Offset: offset, ID: id})
+				in.tracker.add(state, nil)
+			}
+			continue
+		}
+
+		state, err = in.readFile(ctx, name, id, offset, state)
+		if err != nil {
+			in.log.Errorw("Reading alert export file", "file", name, logp.Error(err))
+		}
+		if ctx.Err() != nil {
+			return state, nil
+		}
+	}
+
+	// Positions of removed files are forgotten, so a new file with the
+	// same name is read from the beginning.
+	if len(present) < len(state.Files) {
+		files := make(map[string]checkpoint.FileState, len(present))
+		for name, fs := range state.Files {
+			if present[name] {
+				files[name] = fs
+			}
+		}
+		state.Files = files
+		in.tracker.add(state, nil)
+	}
+	return state, nil
+}
+
+// readFile publishes alerts of the named file with identity id from offset
+// in pages of up to exportBatchSize alerts. Incomplete value at the end of
+// the file is left to be read when the file is complete. Invalid line is
+// skipped.
+func (in *input) readFile(ctx context.Context, name, id string, offset int64, state checkpoint.State) (checkpoint.State, error) {
+	f, err := os.Open(filepath.Join(in.path, name))
+	if err != nil {
+		return state, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return state, err
+	}
+	if file.GetOSState(fi).String() != id {
+		// It is read on the next scan.
+		return state, errors.New("file was replaced while scanning the directory")
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return state, err
+	}
+
+	var (
+		dec   = json.NewDecoder(f)
+		start = offset // Offset where dec started reading.
+		end   = offset // Offset after the last value read.
+		done  = offset // Offset after the last published page.
+		batch = &alertResponse{Alerts: &[]eventAlert{}}
+	)
+	publish := func() {
+		state = in.publishExport(name, checkpoint.FileState{Offset: end, ID: id}, batch, state)
+		batch = &alertResponse{Alerts: &[]eventAlert{}}
+		done = end
+	}
+
+	for ctx.Err() == nil {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			// Only white space is left, e.g. the last line end.
+			n, _ := io.Copy(ioutil.Discard, dec.Buffered())
+			end = start + dec.InputOffset() + n
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			next, nerr := nextLine(f, end)
+			if nerr != nil || next < 0 {
+				// Rest of the line is not written yet.
+				break
+			}
+			in.log.Warnw("Skipping invalid data in export file", "file", name,
+				"offset", end, logp.Error(err))
+			end, start = next, next
+			if _, err := f.Seek(next, io.SeekStart); err != nil {
+				return state, err
+			}
+			dec = json.NewDecoder(f)
+			continue
+		}
+		end = start + dec.InputOffset()
+
+		if err := addExport(batch, raw); err != nil {
+			in.log.Warnw("Skipping invalid value in export file", "file", name,
+				"offset", end-int64(len(raw)), logp.Error(err))
+			continue
+		}
+		if len(*batch.Alerts) >= exportBatchSize {
+			publish()
+		}
+	}
+
+	if end > done {
+		// Skipped data is not read again either.
+		publish()
+	}
+	return state, nil
+}
+
+// publishExport publishes alerts of the page of the named file ending at
+// the offset of fs and returns the state after them.
+func (in *input) publishExport(name string, fs checkpoint.FileState, body *alertResponse, state checkpoint.State) checkpoint.State {
+	events := in.converter.beatEvents(body)
+
+	state = state.WithFile(name, fs)
+	if t := lastAlertTime(body); t.After(state.LastAlertTime) {
+		state.LastAlertTime = t
+	}
+	state.Pages++
+	state.Events += int64(len(events))
+	state.LastSuccess = time.Now().UTC()
+	in.tracker.add(state, events)
+	in.publishAll(events)
+	return state
+}
+
+// addExport adds alerts of the value read from export file to batch. The
+// value is either alerts response, single alert or array of alerts.
+func addExport(batch *alertResponse, raw json.RawMessage) error {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '[' {
+		var alerts []eventAlert
+		if err := json.Unmarshal(raw, &alerts); err != nil {
+			return err
+		}
+		*batch.Alerts = append(*batch.Alerts, alerts...)
+		return nil
+	}
+
+	var probe struct {
+		Alerts *json.RawMessage `json:"alerts"`
+		Type   string           `json:"eventType"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return err
+	}
+
+	switch {
+	case probe.Alerts != nil:
+		var resp alertResponse
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			return err
+		}
+		if resp.Alerts != nil {
+			*batch.Alerts = append(*batch.Alerts, *resp.Alerts...)
+		}
+		for t, info := range resp.Threats {
+			if batch.Threats == nil {
+				batch.Threats = map[string]threatInfo{}
+			}
+			batch.Threats[t] = info
+		}
+	case probe.Type != "":
+		var alert eventAlert
+		if err := json.Unmarshal(raw, &alert); err != nil {
+			return err
+		}
+		*batch.Alerts = append(*batch.Alerts, alert)
+	default:
+		return fmt.Errorf("value is neither alerts response nor alert")
+	}
+	return nil
+}
+
+// nextLine returns offset of the line following the data starting at
+// offset, or -1 if the line is not complete yet.
+func nextLine(f *os.File, offset int64) (int64, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(f)
+	n := offset
+	// Skip the end of the previous line.
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return -1, nil
+		} else if err != nil {
+			return 0, err
+		}
+		n++
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			break
+		}
+	}
+	for {
+		line, err := r.ReadSlice('\n')
+		n += int64(len(line))
+		switch {
+		case err == nil:
+			return n, nil
+		case err == io.EOF:
+			return -1, nil
+		case err != bufio.ErrBufferFull:
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package beater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const exportResponse = `{
+	"follow": "6-8263d641",
+	"alerts": [
+		{"eventType": "dns", "event": {"ts": "2021-04-07T09:55:37Z", "query": "a.example.net"}, "threats": ["c2_communication"]},
+		{"eventType": "dns", "event": {"ts": "2021-04-07T09:56:37Z", "query": "b.example.net"}, "threats": ["c2_communication"]}
+	],
+	"threats": {"c2_communication": {"title": "C2 communication attempt indicating infection", "severity": 5}}
+}
+`
+
+// exportAlert returns alert of the query as written to export file.
+func exportAlert(query string) string {
+	return `{"eventType": "dns", "event": {"ts": "2021-04-07T10:00:00Z", "query": "` + query + `"}, "threats": ["c2_communication"]}`
+}
+
+// exportLine returns alert of the query as NDJSON line.
+func exportLine(query string) string {
+	return exportAlert(query) + "\n"
+}
+
+// appendFile appends data to the file.
+func appendFile(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(data)
+	require.NoError(t, err)
+}
+
+// publishedQueries returns queries of the events published to p.
+func publishedQueries(p *fakePipeline) []interface{} {
+	var queries []interface{}
+	for _, e := range p.published() {
+		queries = append(queries, e.Fields["alphasoc.event.query"])
+	}
+	return queries
+}
+
+func TestRun_FileInput(t *testing.T) {
+	dir := t.TempDir()
+	appendFile(t, filepath.Join(dir, "export-1.json"), exportResponse)
+	ndjson := filepath.Join(dir, "export-2.ndjson")
+	appendFile(t, ndjson, exportLine("c.example.net")+"{not json\n"+exportLine("d.example.net")+
+		`{"eventType": "dns", "ev`)
+	appendFile(t, filepath.Join(dir, "export-3.json"), "["+exportAlert("e.example.net")+"]")
+	appendFile(t, filepath.Join(dir, "notes.txt"), exportLine("ignored.example.net"))
+
+	settings := map[string]interface{}{
+		"registry_file": filepath.Join(t.TempDir(), "checkpoint.yaml"),
+		"inputs": []map[string]interface{}{
+			{"name": "site-a", "type": "file", "path": dir, "period": "10ms"},
+		},
+	}
+	bt := newTestBeatWith(t, New, "http://127.0.0.1:1", settings)
+	p := &fakePipeline{autoACK: true}
+	done := runBeat(bt, p)
+
+	require.Eventually(t, func() bool { return len(p.published()) == 5 },
+		5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, []interface{}{"a.example.net", "b.example.net", "c.example.net", "d.example.net",
+		"e.example.net"}, publishedQueries(p))
+	assert.Equal(t, severity(5), p.published()[0].Fields["alphasoc.threat.severity"])
+
+	// Incomplete line is read when it is complete.
+	appendFile(t, ndjson, `ent": {"ts": "2021-04-07T10:00:00Z", "query": "f.example.net"}, "threats": ["c2_communication"]}`+"\n")
+	require.Eventually(t, func() bool { return len(p.published()) == 6 },
+		5*time.Second, 5*time.Millisecond)
+
+	bt.Stop()
+	require.NoError(t, <-done)
+
+	s := readRegistry(t, bt)
+	for _, name := range []string{"export-1.json", "export-2.ndjson", "export-3.json"} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, fi.Size(), s.Files[name].Offset, name)
+	}
+	assert.NotContains(t, s.Files, "notes.txt")
+	assert.Equal(t, int64(6), s.Events)
+
+	// Restarted beat reads only new data, positions of removed files are
+	// forgotten.
+	require.NoError(t, os.Remove(filepath.Join(dir, "export-1.json")))
+	appendFile(t, ndjson, exportLine("g.example.net"))
+	bt = newTestBeatWith(t, New, "http://127.0.0.1:1", settings)
+	p = &fakePipeline{autoACK: true}
+	done = runBeat(bt, p)
+	require.Eventually(t, func() bool { return len(p.published()) == 1 },
+		5*time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	bt.Stop()
+	require.NoError(t, <-done)
+
+	assert.Equal(t, []interface{}{"g.example.net"}, publishedQueries(p))
+	assert.NotContains(t, readRegistry(t, bt).Files, "export-1.json")
+}
+
+func TestRun_FileInputTruncated(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "export.ndjson")
+	appendFile(t, file, exportLine("a.example.net")+exportLine("b.example.net"))
+
+	bt := newTestBeatWith(t, New, "http://127.0.0.1:1", map[string]interface{}{
+		"inputs": []map[string]interface{}{
+			{"name": "site-a", "type": "file", "path": dir, "period": "10ms"},
+		},
+	})
+	p := &fakePipeline{autoACK: true}
+	done := runBeat(bt, p)
+	require.Eventually(t, func() bool { return len(p.published()) == 2 },
+		5*time.Second, 5*time.Millisecond)
+
+	// Truncated file is read from the beginning.
+	require.NoError(t, ioutil.WriteFile(file, []byte(exportLine("c.example.net")), 0600))
+	require.Eventually(t, func() bool { return len(p.published()) == 3 },
+		5*time.Second, 5*time.Millisecond)
+
+	bt.Stop()
+	require.NoError(t, <-done)
+	assert.Equal(t, "c.example.net", p.published()[2].Fields["alphasoc.event.query"])
+}
+
+func TestRun_FileInputReplaced(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "export.ndjson")
+	appendFile(t, file, exportLine("a.example.net"))
+
+	bt := newTestBeatWith(t, New, "http://127.0.0.1:1", map[string]interface{}{
+		"inputs": []map[string]interface{}{
+			{"name": "site-a", "type": "file", "path": dir, "period": "10ms"},
+		},
+	})
+	p := &fakePipeline{autoACK: true}
+	done := runBeat(bt, p)
+	require.Eventually(t, func() bool { return len(p.published()) == 1 },
+		5*time.Second, 5*time.Millisecond)
+
+	// File replaced by a larger one is read from the beginning, not from
+	// the offset reached in the previous file.
+	tmp := filepath.Join(dir, "export.tmp")
+	appendFile(t, tmp, exportLine("b.example.net")+exportLine("c.example.net"))
+	require.NoError(t, os.Rename(tmp, file))
+	require.Eventually(t, func() bool { return len(p.published()) == 3 },
+		5*time.Second, 5*time.Millisecond)
+
+	bt.Stop()
+	require.NoError(t, <-done)
+	assert.Equal(t, []interface{}{"a.example.net", "b.example.net", "c.example.net"}, publishedQueries(p))
+
+	fi, err := os.Stat(file)
+	require.NoError(t, err)
+	s := readRegistry(t, bt).Files["export.ndjson"]
+	assert.Equal(t, fi.Size(), s.Offset)
+	assert.NotEmpty(t, s.ID)
+}
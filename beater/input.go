@@ -0,0 +1,249 @@
+package beater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/backoff"
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc"
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+// input fetches alerts of a single AlphaSOC account and publishes them
+// with its own publisher client and registry cursor.
+type input struct {
+	name      string
+	config    config.Config
+	fields    common.MapStr
+	client    beat.Client
+	tracker   *pageTracker
+	cursor    *checkpoint.Cursor
+	converter *converter
+	api       *alphasoc.Client
+
+	// path is the directory of alert export files read by file input,
+	// instead of fetching alerts from API.
+	path string
+
+	// webhook holds settings of webhook input receiving alerts pushed to
+	// it instead of fetching them. listening is called with the address of
+	// its server once it accepts connections.
+	webhook   *config.WebhookConfig
+	listening func(addr net.Addr)
+
+	// Bounds of the backoff between alerts requests.
+	backoffInit time.Duration
+	backoffMax  time.Duration
+
+	// backfill is set when fetching alerts from a time window instead of
+	// following new alerts.
+	backfill *backfill
+
+	log *logp.Logger
+}
+
+// newInput creates input of the account given by ic keeping its position
+// in cursor, the other settings are taken from c. API responses are
+// recorded by rec unless it is nil.
+func newInput(c config.Config, ic config.InputConfig, cursor *checkpoint.Cursor, rec *recorder) (*input, error) {
+	c = inputConfig(c, ic)
+
+	var api *alphasoc.Client
+	if ic.Type != config.InputFile && ic.Type != config.InputWebhook {
+		var opts []alphasoc.Option
+		if rec != nil {
+			opts = append(opts, rec.hook(ic.Name))
+		}
+		var err error
+		if api, err = newAPIClient(c, opts...); err != nil {
+			return nil, fmt.Errorf("creating api client: %w", err)
+		}
+	}
+
+	in := &input{
+		name:      ic.Name,
+		config:    c,
+		fields:    inputFields(ic),
+		cursor:    cursor,
+		converter: newConverter(c.Fingerprint),
+		api:       api,
+		path:      ic.Path,
+
+		backoffInit: 1 * time.Second,
+		backoffMax:  ic.Period,
+
+		log: logp.NewLogger("alphasocbeat"),
+	}
+	in.converter.configure(c)
+	if ic.Type == config.InputWebhook {
+		webhook := ic.Webhook
+		in.webhook = &webhook
+	}
+	if ic.Name != "" {
+		in.converter.tenant = ic.Name
+		in.log = in.log.With("input", ic.Name)
+	}
+
+	return in, nil
+}
+
+// inputConfig returns c with the account settings of the input.
+func inputConfig(c config.Config, ic config.InputConfig) config.Config {
+	c.APIURL = ic.APIURL
+	c.APIKey = ic.APIKey
+	c.RegistryFile = ic.RegistryFile
+	c.Period = ic.Period
+	return c
+}
+
+// inputFields returns fields added to every event of the input.
+func inputFields(ic config.InputConfig) common.MapStr {
+	fields := common.MapStr{}
+	if ic.Name != "" {
+		fields["alphasoc.tenant"] = ic.Name
+	}
+	if len(ic.Fields) > 0 {
+		if ic.FieldsUnderRoot {
+			fields.DeepUpdate(ic.Fields.Clone())
+		} else {
+			fields["fields"] = ic.Fields.Clone()
+		}
+	}
+	return fields
+}
+
+// connect connects the input to the publisher pipeline. Publishing is
+// aborted when closeRef is done.
+func (in *input) connect(pipeline beat.Pipeline, closeRef beat.CloseRef) error {
+	// Follow token is persisted only after the output acknowledged
+	// all events of a page, so no alerts are lost on crash or output outage.
+	in.tracker = newPageTracker(in.cursor.Persist)
+
+	var err error
+	in.client, err = pipeline.ConnectWith(beat.ClientConfig{
+		PublishMode: beat.GuaranteedSend,
+		ACKHandler:  in.tracker.acker(),
+		CloseRef:    closeRef,
+	})
+	return err
+}
+
+// run fetches and publishes alerts until ctx is cancelled or an error
+// that cannot be retried occurs.
+func (in *input) run(ctx context.Context) error {
+	switch {
+	case in.webhook != nil:
+		return in.runWebhook(ctx)
+	case in.api == nil:
+		return in.runFiles(ctx)
+	}
+
+	state := in.cursor.State()
+	if in.backfill != nil && in.backfill.done(state) {
+		return in.backfill.finish(ctx, in.tracker, in.cursor)
+	}
+
+	back := backoff.NewExpBackoff(ctx.Done(), in.backoffInit, in.backoffMax)
+	for {
+		if !back.Wait() {
+			return nil
+		}
+
+		body, err := in.api.Query(ctx, in.query(state))
+		if err != nil {
+			if ctx.Err() != nil {
+				// Stopped while waiting for the response.
+				return nil
+			}
+
+			var invalidFollowErr *alphasoc.InvalidFollowError
+			if errors.As(err, &invalidFollowErr) && in.config.InvalidFollow == config.InvalidFollowResume {
+				state = in.recoverFollow(state)
+				continue
+			}
+
+			delay, err := in.handleAPIError(err)
+			if err != nil {
+				return err
+			}
+			if delay > 0 && !sleep(ctx.Done(), delay) {
+				return nil
+			}
+			continue
+		}
+
+		// Page past the end of the backfill window completes it.
+		reached := in.backfill != nil && in.backfill.clip(body)
+
+		events := in.converter.beatEvents(body)
+
+		state.Follow = body.Follow
+		if t := lastAlertTime(body); t.After(state.LastAlertTime) {
+			state.LastAlertTime = t
+		}
+		state.Pages++
+		state.Events += int64(len(events))
+		state.LastSuccess = time.Now().UTC()
+		in.tracker.add(state, events)
+		in.publishAll(events)
+
+		if in.backfill != nil {
+			in.backfill.progress(body, state)
+			if reached || !body.More {
+				return in.backfill.finish(ctx, in.tracker, in.cursor)
+			}
+		}
+
+		if body.More {
+			back.Reset()
+		}
+	}
+}
+
+// query returns alerts query continuing from the state. After is used only
+// when there is no follow token, e.g. when it was rejected by API. Backfill
+// sends the end of the window with every query.
+func (in *input) query(s checkpoint.State) alphasoc.Query {
+	q := alphasoc.Query{
+		Follow: s.Follow,
+		After:  s.LastAlertTime,
+	}
+
+	if in.backfill != nil {
+		if q.After.Before(in.backfill.from) {
+			q.After = in.backfill.from
+		}
+		q.Before = in.backfill.to
+	}
+
+	return q
+}
+
+// publishAll adds the input fields to events and publishes them.
+func (in *input) publishAll(events []beat.Event) {
+	for i := range events {
+		events[i].Fields.DeepUpdate(in.fields.Clone())
+	}
+	in.client.PublishAll(events)
+}
+
+// waitACK waits until the output acknowledged published pages or ctx is
+// done.
+func (in *input) waitACK(ctx context.Context) {
+	select {
+	case <-in.tracker.idle():
+	case <-ctx.Done():
+	}
+	if n := in.tracker.pending(); n > 0 {
+		in.log.Warnf("Stopping with %d pages not acknowledged by the output, "+
+			"they will be fetched again after restart", n)
+	}
+}
@@ -43,9 +43,136 @@ var eventFields = map[string]string{
 	"validTo":   "alphasoc.event.valid_to",
 }
 
-// eventFields is map of json wisdom fields names with matching elastic index field name value
+// fingerprintFields is map of pipeline names with json event fields names
+// used to compute document ID of an alert
+var fingerprintFields = map[string][]string{
+	"dns":  {"ts", "srcIP", "srcHost", "srcMac", "srcID", "query", "qtype"},
+	"ip":   {"ts", "srcIP", "srcHost", "srcPort", "srcID", "destIP", "destPort", "proto"},
+	"http": {"ts", "srcIP", "srcHost", "srcPort", "srcID", "destIP", "destPort", "url", "method"},
+	"tls":  {"ts", "srcIP", "srcHost", "srcPort", "srcID", "destIP", "destPort", "certHash", "ja3", "ja3s"},
+}
+
+// defaultFingerprintFields is list of json event fields names used to compute
+// document ID of an alert from pipeline missing in fingerprintFields
+var defaultFingerprintFields = []string{"ts", "srcIP", "srcHost", "srcPort", "srcID", "destIP", "destPort"}
+
+// wisdomFields is map of json wisdom fields names with matching elastic index field name value
 var wisdomFields = map[string]string{
 	"domain": "destination.domain",
 	"flags":  "alphasoc.wisdom.flags",
 	"labels": "alphasoc.wisdom.labels",
 }
+
+// ecsCategorization holds ECS event.category and event.type values of alerts.
+type ecsCategorization struct {
+	category []string
+	types    []string
+}
+
+// eventCategories is map of pipeline names with ECS categorization of their alerts
+var eventCategories = map[string]ecsCategorization{
+	"dns":  {category: []string{"network"}, types: []string{"protocol", "info"}},
+	"ip":   {category: []string{"network"}, types: []string{"connection"}},
+	"http": {category: []string{"network", "web"}, types: []string{"access", "protocol"}},
+	"tls":  {category: []string{"network"}, types: []string{"protocol", "info"}},
+}
+
+// defaultEventCategory is ECS categorization of alerts from pipeline missing
+// in eventCategories
+var defaultEventCategory = ecsCategorization{category: []string{"network"}, types: []string{"info"}}
+
+// attackTechnique is MITRE ATT&CK tactic and technique indicated by a threat.
+type attackTechnique struct {
+	tacticID, tacticName       string
+	techniqueID, techniqueName string
+}
+
+// threatTechniques is map of threat names from the threats catalogue with
+// MITRE ATT&CK technique they indicate, used for ECS threat fields
+var threatTechniques = map[string]attackTechnique{
+	"c2_communication":          {"TA0011", "Command and Control", "T1071", "Application Layer Protocol"},
+	"sinkholed_destination":     {"TA0011", "Command and Control", "T1071", "Application Layer Protocol"},
+	"unusual_port":              {"TA0011", "Command and Control", "T1571", "Non-Standard Port"},
+	"suspicious_domain_volume":  {"TA0011", "Command and Control", "T1568", "Dynamic Resolution"},
+	"unreachable_domain_volume": {"TA0011", "Command and Control", "T1568", "Dynamic Resolution"},
+}
+
+// ecsEventFields is map of json event fields names with matching ECS field
+// name, used instead of eventFields with mapping_version 2. The legacy fields
+// become aliases of the ECS fields in the index template.
+var ecsEventFields = map[string]string{
+	// Event header
+	"srcUser": "source.user.name",
+
+	// DNS
+	"query": "dns.question.name",
+
+	// HTTP
+	"method":      "http.request.method",
+	"status":      "http.response.status_code",
+	"contentType": "http.response.mime_type",
+	"referrer":    "http.request.referrer",
+	"userAgent":   "user_agent.original",
+
+	// IP
+	"action": "event.action",
+
+	// TLS
+	"ja3":       "tls.client.ja3",
+	"ja3s":      "tls.server.ja3s",
+	"certHash":  "tls.server.hash.sha1",
+	"issuer":    "tls.server.x509.issuer.distinguished_name",
+	"subject":   "tls.server.x509.subject.distinguished_name",
+	"validFrom": "tls.server.x509.not_before",
+	"validTo":   "tls.server.x509.not_after",
+}
+
+// rawFieldAliases is map of legacy fields holding copies of event fields
+// with matching ECS field name, they are not set with mapping_version 2.
+var rawFieldAliases = map[string]string{
+	"alphasoc.event.dest.ip_raw":  "destination.ip",
+	"alphasoc.event.dest.url_raw": "url.original",
+}
+
+// destinationFields is list of json event fields names per pipeline, which
+// are copied to alphasoc.destination. With mapping_version 1 the index
+// template copies them.
+var destinationFields = map[string][]string{
+	"dns":  {"query", "certHash"},
+	"ip":   {"query", "certHash", "destIP"},
+	"http": {"query", "certHash", "url"},
+	"tls":  {"query", "certHash"},
+}
+
+// defaultDestinationFields is list of json event fields names copied to
+// alphasoc.destination for pipeline missing in destinationFields
+var defaultDestinationFields = []string{"query", "certHash"}
+
+// fieldValueTypes is map of elastic index field names with the type values
+// of attributes mapped to them are normalised to, fields missing here get
+// the values as decoded from the alert. It includes ECS fields the mappings
+// setting may map attributes to.
+var fieldValueTypes = map[string]valueType{
+	"source.ip":         ipValue,
+	"source.mac":        macValue,
+	"source.port":       intValue,
+	"source.bytes":      intValue,
+	"destination.ip":    ipValue,
+	"destination.port":  intValue,
+	"destination.bytes": intValue,
+	"event.duration":    durationValue,
+
+	"alphasoc.event.valid_from":  dateValue,
+	"alphasoc.event.valid_to":    dateValue,
+	"http.response.status_code":  intValue,
+	"tls.server.x509.not_before": dateValue,
+	"tls.server.x509.not_after":  dateValue,
+
+	"client.ip":             ipValue,
+	"client.port":           intValue,
+	"server.ip":             ipValue,
+	"server.port":           intValue,
+	"network.bytes":         intValue,
+	"event.risk_score":      floatValue,
+	"event.risk_score_norm": floatValue,
+}
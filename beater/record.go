@@ -0,0 +1,250 @@
+package beater
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/paths"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc"
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+// Names of the recording files are recordPrefix, the UTC time the file was
+// created and recordSuffix, so they sort in the order they were written.
+const (
+	recordPrefix     = "responses-"
+	recordSuffix     = ".ndjson.gz"
+	recordTimeLayout = "20060102T150405.000000000"
+)
+
+// record is a raw alerts response together with the query it answered.
+// Records are written to the recording files as NDJSON.
+type record struct {
+	Time     time.Time       `json:"time"`
+	Input    string          `json:"input,omitempty"`
+	Query    recordQuery     `json:"query"`
+	Response json.RawMessage `json:"response"`
+}
+
+// recordQuery is the alerts query of a record.
+type recordQuery struct {
+	Follow string    `json:"follow,omitempty"`
+	After  time.Time `json:"after,omitempty"`
+	Before time.Time `json:"before,omitempty"`
+}
+
+// recorder writes records to gzip compressed files in a directory. The
+// file is rotated when the size of records written to it reaches maxSize,
+// and only the newest files are kept.
+type recorder struct {
+	dir     string
+	maxSize int64
+	files   int
+
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+	size int64
+
+	log *logp.Logger
+}
+
+// newRecorder returns recorder writing to the directory given by c, which
+// is created if it does not exist.
+func newRecorder(c config.RecordConfig) (*recorder, error) {
+	dir := paths.Resolve(paths.Data, c.Path)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("creating recordings directory: %w", err)
+	}
+
+	return &recorder{
+		dir:     dir,
+		maxSize: int64(c.RotateEveryKB) * 1024,
+		files:   c.NumberOfFiles,
+		log:     logp.NewLogger("recorder"),
+	}, nil
+}
+
+// hook returns API client option recording the responses of the input.
+func (r *recorder) hook(input string) alphasoc.Option {
+	return alphasoc.WithResponseHook(func(q alphasoc.Query, body []byte) {
+		if err := r.record(input, q, body); err != nil {
+			r.log.Errorw("Failed to record API response", "input", input, logp.Error(err))
+		}
+	})
+}
+
+// record writes the response body of the query. Body which is not valid
+// JSON is written as JSON string.
+func (r *recorder) record(input string, q alphasoc.Query, body []byte) error {
+	rec := record{
+		Time:     time.Now().UTC(),
+		Input:    input,
+		Query:    recordQuery{Follow: q.Follow, After: q.After, Before: q.Before},
+		Response: body,
+	}
+	if !json.Valid(body) {
+		rec.Response, _ = json.Marshal(string(body))
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.gz == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.gz.Write(data); err != nil {
+		return err
+	}
+	// Flushed records can be read back even if the beat crashes.
+	if err := r.gz.Flush(); err != nil {
+		return err
+	}
+	r.size += int64(len(data))
+
+	if r.size >= r.maxSize {
+		return r.closeFile()
+	}
+	return nil
+}
+
+// open creates new recording file and removes the oldest ones.
+func (r *recorder) open() error {
+	name := recordPrefix + time.Now().UTC().Format(recordTimeLayout) + recordSuffix
+	f, err := os.OpenFile(filepath.Join(r.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	r.file, r.gz, r.size = f, gzip.NewWriter(f), 0
+
+	files, err := recordFiles(r.dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > r.files {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// closeFile completes the current recording file.
+func (r *recorder) closeFile() error {
+	if r.gz == nil {
+		return nil
+	}
+	err := r.gz.Close()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file, r.gz = nil, nil
+	return err
+}
+
+// Close completes the current recording file.
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.closeFile()
+}
+
+// recordFiles returns the recording files in dir from the oldest one.
+func recordFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, recordPrefix+"*"+recordSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readRecords reads records of the recording file and passes them to fn
+// until it returns false. Records of truncated file, e.g. the last file
+// written before the beat crashed, are read up to the truncated one.
+func readRecords(path string, fn func(rec record) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	defer gz.Close()
+
+	dec := json.NewDecoder(gz)
+	var last time.Time
+	for {
+		var rec record
+		err := dec.Decode(&rec)
+		switch {
+		case err == io.EOF:
+			return nil
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			logp.Warn("Recording file %s is truncated, records after %s are missing",
+				path, last.Format(time.RFC3339))
+			return nil
+		case err != nil:
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+
+		last = rec.Time
+		if !fn(rec) {
+			return nil
+		}
+	}
+}
+
+// expandRecordFiles returns the recording files given as files or
+// directories holding them, in the order they were written.
+func expandRecordFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+
+		found, err := recordFiles(arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("no recording files %s*%s found in %s",
+				recordPrefix, recordSuffix, arg)
+		}
+		files = append(files, found...)
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	return files, nil
+}
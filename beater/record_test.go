@@ -0,0 +1,151 @@
+package beater
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc"
+	"github.com/alphasoc/alphasocbeat/alphasoc/mockapi"
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+// readAllRecords returns records of the recording files in dir.
+func readAllRecords(t *testing.T, dir string) []record {
+	files, err := expandRecordFiles([]string{dir})
+	require.NoError(t, err)
+
+	var records []record
+	for _, file := range files {
+		require.NoError(t, readRecords(file, func(rec record) bool {
+			records = append(records, rec)
+			return true
+		}))
+	}
+	return records
+}
+
+func TestRecorder_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	r, err := newRecorder(config.RecordConfig{Path: dir, RotateEveryKB: 1, NumberOfFiles: 2})
+	require.NoError(t, err)
+
+	body := fmt.Sprintf(`{"follow": "x", "alerts": [], "pad": "%0600d"}`, 0)
+	for i := 1; i <= 10; i++ {
+		require.NoError(t, r.record("unit-a", alphasoc.Query{Follow: fmt.Sprintf("%d-a", i)}, []byte(body)))
+	}
+	require.NoError(t, r.record("", alphasoc.Query{}, []byte(`{"follow": "trunc`)))
+	require.NoError(t, r.Close())
+
+	files, err := recordFiles(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	// Oldest files are removed.
+	records := readAllRecords(t, dir)
+	require.Len(t, records, 3)
+	assert.Equal(t, "9-a", records[0].Query.Follow)
+	assert.Equal(t, "unit-a", records[0].Input)
+	assert.JSONEq(t, body, string(records[0].Response))
+
+	// Malformed body is kept as string.
+	assert.Equal(t, `"{\"follow\": \"trunc"`, string(records[2].Response))
+}
+
+func TestReadRecords_Truncated(t *testing.T) {
+	dir := t.TempDir()
+	r, err := newRecorder(config.RecordConfig{Path: dir, RotateEveryKB: 1024, NumberOfFiles: 1})
+	require.NoError(t, err)
+
+	// File of crashed beat is not completed.
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, r.record("", alphasoc.Query{Follow: fmt.Sprintf("%d-a", i)}, []byte(`{}`)))
+	}
+	defer r.Close()
+
+	records := readAllRecords(t, dir)
+	require.Len(t, records, 3)
+	assert.Equal(t, "3-a", records[2].Query.Follow)
+}
+
+func TestReplay(t *testing.T) {
+	ts := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	api, apiURL := newMockAPI(t,
+		mockapi.Page("1-a", true,
+			mockapi.Alert(ts, "a.example.net", "c2_communication"),
+			mockapi.Alert(ts.Add(time.Minute), "b.example.net", "suspicious_domain_volume")),
+		mockapi.Malformed(),
+		mockapi.Page("2-b", false),
+	)
+	dir := t.TempDir()
+	settings := map[string]interface{}{
+		"record.enabled": true,
+		"record.path":    dir,
+		"inputs": []map[string]interface{}{
+			{"name": "unit-a", "api_key": "key-a", "fields": map[string]interface{}{"site": "hq"}},
+		},
+	}
+
+	bt := newTestBeatWith(t, New, apiURL, settings)
+	recorded := &fakePipeline{autoACK: true}
+	done := runBeat(bt, recorded)
+	require.Eventually(t, func() bool { return api.Pending() == 0 && len(recorded.published()) == 2 },
+		5*time.Second, 5*time.Millisecond)
+	bt.Stop()
+	require.NoError(t, <-done)
+	require.Len(t, recorded.published(), 2)
+
+	// Recorded alerts are published again without the API.
+	cfg, err := common.NewConfigFrom(map[string]interface{}{"api_url": "http://127.0.0.1:1"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Merge(settings))
+	b, err := NewReplay([]string{dir})(&beat.Beat{}, cfg)
+	require.NoError(t, err)
+	r := b.(*replay)
+	out := &bytes.Buffer{}
+	r.out = out
+
+	replayed := &fakePipeline{autoACK: true}
+	require.NoError(t, r.Run(&beat.Beat{Publisher: replayed}))
+	// Empty pages polled after the script are replayed too.
+	n := len(readAllRecords(t, dir))
+	assert.Equal(t, fmt.Sprintf("Replay complete: %d responses, 2 alerts, 1 responses skipped\n", n-1), out.String())
+
+	want, got := recorded.published(), replayed.published()
+	require.Len(t, got, len(want))
+	for i := range want {
+		assert.Equal(t, want[i].Meta, got[i].Meta)
+		assert.Equal(t, want[i].Fields, got[i].Fields)
+		assert.Equal(t, "hq", got[i].Fields["fields"].(common.MapStr)["site"])
+	}
+}
+
+func TestReplay_WithoutAlerts(t *testing.T) {
+	dir := t.TempDir()
+	r, err := newRecorder(config.RecordConfig{Path: dir, RotateEveryKB: 1024, NumberOfFiles: 1})
+	require.NoError(t, err)
+	require.NoError(t, r.record("unit-a", alphasoc.Query{}, []byte(`{"follow": "1-a"}`)))
+	require.NoError(t, r.record("unit-a", alphasoc.Query{Follow: "1-a"}, []byte(exportResponse)))
+	require.NoError(t, r.record("unit-a", alphasoc.Query{Follow: "2-a"}, []byte(`{"follow": "2-a", "alerts": null}`)))
+	require.NoError(t, r.Close())
+
+	cfg, err := common.NewConfigFrom(map[string]interface{}{"api_url": "http://127.0.0.1:1"})
+	require.NoError(t, err)
+	b, err := NewReplay([]string{dir})(&beat.Beat{}, cfg)
+	require.NoError(t, err)
+	rp := b.(*replay)
+	out := &bytes.Buffer{}
+	rp.out = out
+
+	// Responses without alerts are replayed as empty pages.
+	p := &fakePipeline{autoACK: true}
+	require.NoError(t, rp.Run(&beat.Beat{Publisher: p}))
+	assert.Equal(t, "Replay complete: 3 responses, 2 alerts, 0 responses skipped\n", out.String())
+	assert.Equal(t, []interface{}{"a.example.net", "b.example.net"}, publishedQueries(p))
+}
@@ -0,0 +1,193 @@
+package beater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+// replay publishes alerts of recorded API responses without contacting
+// the API. Registry is not used.
+type replay struct {
+	config config.Config
+	files  []string
+	inputs map[string]config.InputConfig
+
+	// targets publish the records of an input, keyed by the input name.
+	targets  map[string]*replayTarget
+	pipeline beat.Pipeline
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	records, skipped, alerts int
+	out                      io.Writer
+
+	log *logp.Logger
+}
+
+// replayTarget converts and publishes records of a single input.
+type replayTarget struct {
+	converter *converter
+	fields    common.MapStr
+	client    beat.Client
+	tracker   *pageTracker
+}
+
+// NewReplay returns creator of beat publishing alerts of the recording files
+// given as files or directories, and stopping when all of them are
+// published. Alerts are converted with the current settings of the input
+// which recorded them.
+func NewReplay(paths []string) beat.Creator {
+	return func(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
+		c, err := unpackConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := useMappingVersion(b, c); err != nil {
+			return nil, err
+		}
+
+		files, err := expandRecordFiles(paths)
+		if err != nil {
+			return nil, err
+		}
+
+		r := &replay{
+			config:  c,
+			files:   files,
+			inputs:  map[string]config.InputConfig{},
+			targets: map[string]*replayTarget{},
+			out:     os.Stdout,
+			log:     logp.NewLogger("replay"),
+		}
+		for _, ic := range c.InputList() {
+			r.inputs[ic.Name] = ic
+		}
+		r.ctx, r.cancel = context.WithCancel(context.Background())
+		return r, nil
+	}
+}
+
+// Run publishes the records of all files in order and waits until the
+// output acknowledged them.
+func (r *replay) Run(b *beat.Beat) error {
+	r.pipeline = b.Publisher
+	defer r.closeTargets()
+
+	for _, file := range r.files {
+		r.log.Infof("Replaying %s", file)
+		var err error
+		rerr := readRecords(file, func(rec record) bool {
+			err = r.publish(rec)
+			return err == nil && r.ctx.Err() == nil
+		})
+		if err != nil {
+			return err
+		}
+		if rerr != nil {
+			return rerr
+		}
+		if r.ctx.Err() != nil {
+			return nil
+		}
+	}
+
+	for _, t := range r.targets {
+		select {
+		case <-t.tracker.idle():
+		case <-r.ctx.Done():
+			return nil
+		}
+	}
+
+	fmt.Fprintf(r.out, "Replay complete: %d responses, %d alerts, %d responses skipped\n",
+		r.records, r.alerts, r.skipped)
+	return nil
+}
+
+// publish converts the recorded response to events and publishes them.
+// Responses which cannot be decoded are skipped.
+func (r *replay) publish(rec record) error {
+	body := &alertResponse{}
+	if err := json.Unmarshal(rec.Response, body); err != nil {
+		r.skipped++
+		r.log.Warnw("Skipping recorded response which cannot be decoded",
+			"input", rec.Input, "time", rec.Time, logp.Error(err))
+		return nil
+	}
+
+	t, err := r.target(rec.Input)
+	if err != nil {
+		return err
+	}
+
+	events := t.converter.beatEvents(body)
+	for i := range events {
+		events[i].Fields.DeepUpdate(t.fields.Clone())
+	}
+	t.tracker.add(checkpoint.State{}, events)
+	t.client.PublishAll(events)
+
+	r.records++
+	r.alerts += len(events)
+	return nil
+}
+
+// target returns target of the named input, connecting it on first use.
+// Input which is not configured any more gets only the tenant field.
+func (r *replay) target(name string) (*replayTarget, error) {
+	if t, ok := r.targets[name]; ok {
+		return t, nil
+	}
+
+	ic, ok := r.inputs[name]
+	if !ok {
+		r.log.Warnf("Input %q of recorded responses is not configured, "+
+			"its fields are not added", name)
+		ic = config.InputConfig{Name: name}
+	}
+
+	t := &replayTarget{
+		converter: newConverter(r.config.Fingerprint),
+		fields:    inputFields(ic),
+		tracker:   newPageTracker(func(checkpoint.State) {}),
+	}
+	t.converter.tenant = name
+	t.converter.configure(r.config)
+
+	var err error
+	t.client, err = r.pipeline.ConnectWith(beat.ClientConfig{
+		PublishMode: beat.GuaranteedSend,
+		ACKHandler:  t.tracker.acker(),
+		CloseRef:    r.ctx,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.targets[name] = t
+	return t, nil
+}
+
+// closeTargets closes the publisher clients.
+func (r *replay) closeTargets() {
+	for _, t := range r.targets {
+		t.client.Close()
+	}
+}
+
+// Stop stops replaying and aborts publishing, alerts not acknowledged yet
+// may be lost.
+func (r *replay) Stop() {
+	r.cancel()
+}
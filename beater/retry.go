@@ -0,0 +1,109 @@
+package beater
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc"
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+)
+
+// handleAPIError decides how to proceed after failed alerts request. It
+// returns the minimum delay before the next request, which is zero if the
+// regular backoff applies, or an error if the beat should stop. Network
+// failures, including broken or truncated responses, are retried; rejected
+// api key with fail_on_auth_error and responses caused by invalid settings,
+// e.g. wrong api_url, stop the input.
+func (in *input) handleAPIError(err error) (time.Duration, error) {
+	var (
+		authErr          *alphasoc.AuthError
+		rateLimitErr     *alphasoc.RateLimitError
+		serverErr        *alphasoc.ServerError
+		invalidFollowErr *alphasoc.InvalidFollowError
+		urlErr           *url.Error
+		responseErr      *alphasoc.ResponseError
+	)
+
+	switch {
+	case errors.As(err, &authErr):
+		in.log.Errorw("API key rejected, check api_key setting",
+			"status", authErr.Status)
+		if in.config.FailOnAuthError {
+			return 0, fmt.Errorf("API key rejected: %w", err)
+		}
+		return 0, nil
+
+	case errors.As(err, &rateLimitErr):
+		in.log.Warnw("Rate limited by API", "retry_after", rateLimitErr.RetryAfter)
+		return rateLimitErr.RetryAfter, nil
+
+	case errors.As(err, &serverErr):
+		in.log.Warnw("API server error", "status", serverErr.Status,
+			"retry_after", serverErr.RetryAfter)
+		return serverErr.RetryAfter, nil
+
+	case errors.As(err, &invalidFollowErr):
+		return 0, fmt.Errorf("invalid cursor: %w", err)
+
+	case errors.As(err, &urlErr):
+		in.log.Errorw("Fetching alerts", logp.Error(err))
+		return 0, nil
+
+	case errors.As(err, &responseErr):
+		in.log.Errorw("Reading alerts response", logp.Error(err))
+		return 0, nil
+	}
+
+	return 0, err
+}
+
+// recoverFollow drops the follow token rejected by API, so that alerts are
+// fetched starting from the last alert seen, and reports the gap in logs and
+// with a status event.
+func (in *input) recoverFollow(s checkpoint.State) checkpoint.State {
+	fields := common.MapStr{
+		"alphasoc.status.type":   "follow_rejected",
+		"alphasoc.status.follow": s.Follow,
+	}
+
+	var msg string
+	if s.LastAlertTime.IsZero() {
+		msg = fmt.Sprintf("Follow token %q rejected by API and time of the last alert "+
+			"is unknown, fetching all alerts available in API", s.Follow)
+	} else {
+		msg = fmt.Sprintf("Follow token %q rejected by API, fetching alerts newer than %s, "+
+			"alerts with older event time which were not fetched yet are missing", s.Follow,
+			s.LastAlertTime.Format(time.RFC3339))
+		fields["alphasoc.status.resume_from"] = s.LastAlertTime
+	}
+	fields["message"] = msg
+
+	in.log.Warn(msg)
+	in.publishAll([]beat.Event{{
+		Timestamp: time.Now(),
+		Fields:    fields,
+	}})
+
+	s.Follow = ""
+	return s
+}
+
+// sleep waits for the duration d or until done is closed. It returns false
+// if done was closed.
+func sleep(done <-chan struct{}, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-done:
+		return false
+	case <-t.C:
+		return true
+	}
+}
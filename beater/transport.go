@@ -0,0 +1,72 @@
+package beater
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc"
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+// newAPIClient creates AlphaSOC API client with transport set up
+// according to the http config section.
+func newAPIClient(c config.Config, opts ...alphasoc.Option) (*alphasoc.Client, error) {
+	u, err := url.Parse(c.APIURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing api url: %w", err)
+	}
+
+	rt, err := newTransport(c.HTTP, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]alphasoc.Option{
+		alphasoc.WithTransport(rt),
+		alphasoc.WithTimeout(c.HTTP.RequestTimeLimit()),
+	}, opts...)
+	return alphasoc.New(c.APIURL, c.APIKey, opts...)
+}
+
+// newTransport creates HTTP transport for connecting to host. Its timeouts
+// limit connecting and waiting for response headers, the whole request is
+// limited by the client, see newAPIClient.
+func newTransport(c config.HTTPConfig, host string) (*http.Transport, error) {
+	tlsConfig, err := tlscommon.LoadTLSConfig(c.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("loading ssl config: %w", err)
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if c.ProxyDisable {
+		proxy = nil
+	} else if c.ProxyURL != "" {
+		u, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing proxy url: %w", err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   c.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig.BuildModuleClientConfig(host),
+		TLSHandshakeTimeout:   c.ConnectTimeout,
+		ResponseHeaderTimeout: c.ResponseTimeout,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		ForceAttemptHTTP2:     true,
+	}, nil
+}
@@ -0,0 +1,246 @@
+package beater
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc/mockapi"
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+// testCA is private certificate authority issuing certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "alphasocbeat test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns certificate and key signed by the CA in PEM format.
+func (ca *testCA) issue(t *testing.T, serial int64, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeTempFile(t *testing.T, name string, data []byte) string {
+	p := filepath.Join(t.TempDir(), name)
+	require.NoError(t, ioutil.WriteFile(p, data, 0600))
+	return p
+}
+
+// testConfig returns default config overridden with the given settings.
+func testConfig(t *testing.T, settings map[string]interface{}) config.Config {
+	cfg, err := common.NewConfigFrom(settings)
+	require.NoError(t, err)
+
+	c := config.DefaultConfig
+	require.NoError(t, cfg.Unpack(&c))
+	return c
+}
+
+func TestAPIClient_PrivateCAMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, 2, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, 3, x509.ExtKeyUsageClientAuth)
+
+	pair, err := tls.X509KeyPair(serverCert, serverKey)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	srv := httptest.NewUnstartedServer(mockapi.New(mockapi.Page("1-00000000", false)))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := writeTempFile(t, "ca.pem", ca.pem)
+	certFile := writeTempFile(t, "client.pem", clientCert)
+	keyFile := writeTempFile(t, "client.key", clientKey)
+
+	t.Run("trusted CA and client certificate", func(t *testing.T) {
+		c := testConfig(t, map[string]interface{}{
+			"api_url":                          srv.URL,
+			"http.ssl.certificate_authorities": []string{caFile},
+			"http.ssl.certificate":             certFile,
+			"http.ssl.key":                     keyFile,
+		})
+
+		api, err := newAPIClient(c)
+		require.NoError(t, err)
+		resp, err := api.Alerts(context.Background(), "")
+		require.NoError(t, err)
+		assert.Equal(t, "1-00000000", resp.Follow)
+	})
+
+	t.Run("missing client certificate", func(t *testing.T) {
+		c := testConfig(t, map[string]interface{}{
+			"api_url":                          srv.URL,
+			"http.ssl.certificate_authorities": []string{caFile},
+		})
+
+		api, err := newAPIClient(c)
+		require.NoError(t, err)
+		_, err = api.Alerts(context.Background(), "")
+		assert.Error(t, err)
+	})
+
+	t.Run("untrusted CA", func(t *testing.T) {
+		c := testConfig(t, map[string]interface{}{
+			"api_url":              srv.URL,
+			"http.ssl.certificate": certFile,
+			"http.ssl.key":         keyFile,
+		})
+
+		api, err := newAPIClient(c)
+		require.NoError(t, err)
+		_, err = api.Alerts(context.Background(), "")
+		assert.Error(t, err)
+	})
+}
+
+func TestAPIClient_Proxy(t *testing.T) {
+	mock := mockapi.New(mockapi.Page("1-00000000", false))
+	api := httptest.NewServer(mock)
+	defer api.Close()
+
+	// Proxy stand-in forwarding plain HTTP requests to the API.
+	var proxied []*http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r)
+		if r.Header.Get("Proxy-Authorization") !=
+			"Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	c := testConfig(t, map[string]interface{}{
+		"api_url":        api.URL,
+		"http.proxy_url": "http://user:secret@" + proxy.Listener.Addr().String(),
+	})
+
+	client, err := newAPIClient(c)
+	require.NoError(t, err)
+	resp, err := client.Alerts(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, "1-00000000", resp.Follow)
+
+	require.Len(t, proxied, 1)
+	assert.Equal(t, api.Listener.Addr().String(), proxied[0].Host)
+}
+
+func TestAPIClient_ResponseTimeout(t *testing.T) {
+	srv := httptest.NewServer(mockapi.New(mockapi.Hanging()))
+	defer srv.Close()
+
+	c := testConfig(t, map[string]interface{}{
+		"api_url":               srv.URL,
+		"http.response_timeout": "50ms",
+	})
+
+	api, err := newAPIClient(c)
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = api.Alerts(context.Background(), "")
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestAPIClient_RequestTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Headers are sent in time, the body is not completed.
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"follow": "1-a", "alerts": [`))
+		w.(http.Flusher).Flush()
+		select {
+		case <-unblock:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	c := testConfig(t, map[string]interface{}{
+		"api_url":               srv.URL,
+		"http.response_timeout": "1s",
+		"http.request_timeout":  "50ms",
+	})
+
+	api, err := newAPIClient(c)
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = api.Alerts(context.Background(), "")
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
@@ -0,0 +1,61 @@
+package beater
+
+import (
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+)
+
+// unmappedMetrics count attributes of alerts without mapping, per pipeline
+// and section of the alert, e.g. alphasocbeat.unmapped.dns.event.
+var unmappedMetrics = monitoring.Default.NewRegistry("alphasocbeat.unmapped")
+
+// unmapped counts the attributes without mapping and logs every attribute
+// the first time it is seen, so changes of the alerts schema are noticed.
+var unmapped = &unmappedKeys{
+	counters: map[string]*monitoring.Int{},
+	seen:     map[string]bool{},
+	log:      logp.NewLogger("alphasocbeat"),
+}
+
+// unmappedKeys counts and logs attributes of alerts without mapping.
+type unmappedKeys struct {
+	mu       sync.Mutex
+	counters map[string]*monitoring.Int
+	seen     map[string]bool
+	log      *logp.Logger
+}
+
+// add counts attributes of the section of alert of the pipeline, which are
+// preserved under the extra fields if preserved is set.
+func (u *unmappedKeys) add(pipeline, section string, keys []string, preserved bool) {
+	if len(keys) == 0 {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	name := pipeline + "." + section
+	counter, ok := u.counters[name]
+	if !ok {
+		counter = monitoring.NewInt(unmappedMetrics, name)
+		u.counters[name] = counter
+	}
+	counter.Add(int64(len(keys)))
+
+	for _, k := range keys {
+		if u.seen[name+"."+k] {
+			continue
+		}
+		u.seen[name+"."+k] = true
+		if preserved {
+			u.log.Warnw("Alerts have attribute without mapping, it is kept under alphasoc."+section+".extra",
+				"pipeline", pipeline, "attribute", section+"."+k)
+		} else {
+			u.log.Warnw("Alerts have attribute without mapping, it is dropped unless it is added "+
+				"to mappings or preserve_unmapped is set", "pipeline", pipeline, "attribute", section+"."+k)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package beater
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+const unmappedResponse = `{
+	"alerts": [{
+		"eventType": "unmapped-test",
+		"event": {
+			"ts": "2021-04-07T09:55:37Z",
+			"srcIP": "10.14.1.39",
+			"query": "hsxfrfokdkojcj.net",
+			"srcGroup": "finance",
+			"dropped": "x",
+			"geo": {"country": "PL"}
+		},
+		"threats": ["c2_communication", "suspicious_domain_volume"],
+		"wisdom": {"flags": ["young_domain"], "score": 0.8}
+	}]
+}`
+
+// unmappedCount returns number of attributes without mapping counted in the
+// section of alerts of the pipeline.
+func unmappedCount(pipeline, section string) int64 {
+	if v, ok := unmappedMetrics.Get(pipeline + "." + section).(*monitoring.Int); ok {
+		return v.Get()
+	}
+	return 0
+}
+
+func TestBeatEvents_PreserveUnmapped(t *testing.T) {
+	body := &alertResponse{}
+	require.NoError(t, json.Unmarshal([]byte(unmappedResponse), body))
+
+	c := newConverter(nil)
+	c.configure(config.Config{
+		MappingVersion:   config.MappingVersionLegacy,
+		PreserveUnmapped: true,
+		Mappings: map[string]config.MappingConfig{
+			"unmapped-test": {Event: map[string]string{"dropped": ""}},
+		},
+	})
+	events := c.beatEvents(body)
+	require.Len(t, events, 2)
+
+	for _, e := range events {
+		assert.Equal(t, common.MapStr{
+			"srcGroup": "finance",
+			"geo":      common.MapStr{"country": "PL"},
+		}, e.Fields["alphasoc.event.extra"])
+		assert.Equal(t, common.MapStr{"score": 0.8}, e.Fields["alphasoc.wisdom.extra"])
+		assert.Equal(t, "hsxfrfokdkojcj.net", e.Fields["alphasoc.event.query"])
+
+		var original eventAlert
+		require.NoError(t, json.Unmarshal([]byte(e.Fields["event.original"].(string)), &original))
+		assert.Equal(t, (*body.Alerts)[0], original)
+	}
+
+	// Extra fields of the events are independent.
+	events[0].Fields["alphasoc.event.extra"].(common.MapStr)["srcGroup"] = "changed"
+	assert.Equal(t, "finance", events[1].Fields["alphasoc.event.extra"].(common.MapStr)["srcGroup"])
+}
+
+func TestBeatEvents_UnmappedCounted(t *testing.T) {
+	body := &alertResponse{}
+	require.NoError(t, json.Unmarshal([]byte(unmappedResponse), body))
+	event, wisdom := unmappedCount("unmapped-test", "event"), unmappedCount("unmapped-test", "wisdom")
+
+	events := newConverter(nil).beatEvents(body)
+	require.Len(t, events, 2)
+	for _, e := range events {
+		assert.NotContains(t, e.Fields, "alphasoc.event.extra")
+		assert.NotContains(t, e.Fields, "alphasoc.wisdom.extra")
+		assert.NotContains(t, e.Fields, "event.original")
+	}
+
+	// Attributes are counted once per alert, not per threat.
+	assert.Equal(t, event+3, unmappedCount("unmapped-test", "event"))
+	assert.Equal(t, wisdom+1, unmappedCount("unmapped-test", "wisdom"))
+}
+
+func TestBeatEvents_UnmappedEmptyValues(t *testing.T) {
+	body := &alertResponse{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"alerts": [{
+			"eventType": "unmapped-empty-test",
+			"event": {"ts": "2021-04-07T09:55:37Z", "srcTeam": "", "srcGroup": "finance"},
+			"threats": ["c2_communication"]
+		}]
+	}`), body))
+	count := unmappedCount("unmapped-empty-test", "event")
+
+	c := newConverter(nil)
+	c.configure(config.Config{MappingVersion: config.MappingVersionLegacy, PreserveUnmapped: true})
+	events := c.beatEvents(body)
+	require.Len(t, events, 1)
+
+	// Empty values are left out, like those of mapped attributes.
+	assert.Equal(t, common.MapStr{"srcGroup": "finance"}, events[0].Fields["alphasoc.event.extra"])
+	assert.Equal(t, count+1, unmappedCount("unmapped-empty-test", "event"))
+}
@@ -0,0 +1,206 @@
+package beater
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+// Headers authenticating the alerts posted to webhook input.
+const (
+	// webhookSignatureHeader holds "sha256=" and hex encoded HMAC-SHA256
+	// of the request body, when auth is config.WebhookAuthHMAC.
+	webhookSignatureHeader = "X-AlphaSOC-Signature"
+	webhookSignaturePrefix = "sha256="
+)
+
+// webhookResponse is the body of the reply to the posted alerts.
+type webhookResponse struct {
+	Events int    `json:"events"`
+	Error  string `json:"error,omitempty"`
+}
+
+// webhookHandler publishes alerts responses posted to webhook input.
+type webhookHandler struct {
+	in *input
+
+	// mu serializes publishing, so pages are added to the tracker in the
+	// order their events are published.
+	mu    sync.Mutex
+	state checkpoint.State
+}
+
+// runWebhook serves the webhook of the input until ctx is cancelled.
+// Requests being handled then are given shutdown_timeout to complete.
+func (in *input) runWebhook(ctx context.Context) error {
+	c := in.webhook
+
+	tlsConfig, err := tlscommon.LoadTLSServerConfig(c.TLS)
+	if err != nil {
+		return fmt.Errorf("loading webhook ssl settings: %w", err)
+	}
+
+	l, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return fmt.Errorf("webhook listen: %w", err)
+	}
+	scheme := "http"
+	if tlsConfig != nil {
+		host, _, _ := net.SplitHostPort(c.Listen)
+		l = tls.NewListener(l, tlsConfig.BuildServerConfig(host))
+		scheme = "https"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(c.Path, &webhookHandler{in: in, state: in.cursor.State()})
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		sctx, cancel := context.WithTimeout(context.Background(), in.config.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			in.log.Warnw("Webhook requests did not complete before shutdown", logp.Error(err))
+			srv.Close()
+		}
+	}()
+
+	in.log.Infof("Receiving alerts at %s://%s%s", scheme, l.Addr(), c.Path)
+	if in.listening != nil {
+		in.listening(l.Addr())
+	}
+
+	err = srv.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// ServeHTTP publishes events of the posted alerts response and replies
+// when they are queued by the publisher pipeline.
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := h.in.webhook
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		h.reply(w, http.StatusMethodNotAllowed, 0, "method not allowed")
+		return
+	}
+
+	// A byte more than the limit is read, so larger body is told apart
+	// from a body which cannot be read, e.g. cut by the client.
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, c.MaxBodySize+1))
+	switch {
+	case err != nil:
+		h.in.log.Warnw("Rejected webhook request with unreadable body", "remote", r.RemoteAddr, logp.Error(err))
+		h.reply(w, http.StatusBadRequest, 0, "reading body: "+err.Error())
+		return
+	case int64(len(body)) > c.MaxBodySize:
+		w.Header().Set("Connection", "close")
+		h.reply(w, http.StatusRequestEntityTooLarge, 0,
+			fmt.Sprintf("body larger than %d bytes", c.MaxBodySize))
+		return
+	}
+
+	if !h.authenticated(r, body) {
+		h.in.log.Warnw("Rejected unauthenticated webhook request", "remote", r.RemoteAddr)
+		h.reply(w, http.StatusUnauthorized, 0, "unauthorized")
+		return
+	}
+
+	resp := &alertResponse{}
+	if err := json.Unmarshal(body, resp); err != nil {
+		h.in.log.Warnw("Rejected webhook request with invalid alerts response",
+			"remote", r.RemoteAddr, logp.Error(err))
+		h.reply(w, http.StatusBadRequest, 0, "invalid alerts response: "+err.Error())
+		return
+	}
+
+	n := h.publish(resp)
+	h.reply(w, http.StatusOK, n, "")
+}
+
+// publish publishes events of the alerts response and returns their number.
+func (h *webhookHandler) publish(resp *alertResponse) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events := h.in.converter.beatEvents(resp)
+
+	if t := lastAlertTime(resp); t.After(h.state.LastAlertTime) {
+		h.state.LastAlertTime = t
+	}
+	h.state.Pages++
+	h.state.Events += int64(len(events))
+	h.state.LastSuccess = time.Now().UTC()
+	h.in.tracker.add(h.state, events)
+	// Events are published in guaranteed mode, so PublishAll returns
+	// when they are queued.
+	h.in.publishAll(events)
+	return len(events)
+}
+
+// authenticated reports whether the request carries the secret, or the
+// signature of body made with it, as selected by the auth setting.
+func (h *webhookHandler) authenticated(r *http.Request, body []byte) bool {
+	c := h.in.webhook
+
+	switch c.Auth {
+	case config.WebhookAuthHMAC:
+		sig := r.Header.Get(webhookSignatureHeader)
+		if !strings.HasPrefix(sig, webhookSignaturePrefix) {
+			return false
+		}
+		got, err := hex.DecodeString(strings.TrimPrefix(sig, webhookSignaturePrefix))
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha256.New, []byte(c.Secret))
+		mac.Write(body)
+		return hmac.Equal(got, mac.Sum(nil))
+	default:
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return false
+		}
+		token := strings.TrimPrefix(auth, "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(token), []byte(c.Secret)) == 1
+	}
+}
+
+// reply writes JSON response with the number of published events, or the
+// error message.
+func (h *webhookHandler) reply(w http.ResponseWriter, status, events int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(webhookResponse{Events: events, Error: msg})
+}
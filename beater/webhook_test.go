@@ -0,0 +1,183 @@
+package beater
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc/mockapi"
+)
+
+// webhookAddr returns channel receiving address of the webhook server of
+// the named input once it listens.
+func webhookAddr(bt *alphasocbeat, name string) <-chan string {
+	addr := make(chan string, 1)
+	for _, in := range bt.inputs {
+		if in.name == name {
+			in.listening = func(a net.Addr) { addr <- a.String() }
+		}
+	}
+	return addr
+}
+
+// postAlerts posts body to the webhook with the headers and returns the
+// response status and body.
+func postAlerts(t *testing.T, client *http.Client, url, body string, header map[string]string) (int, webhookResponse) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var r webhookResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&r))
+	return resp.StatusCode, r
+}
+
+func TestRun_Webhook(t *testing.T) {
+	settings := map[string]interface{}{
+		"inputs": []map[string]interface{}{{
+			"name": "push",
+			"type": "webhook",
+			"webhook": map[string]interface{}{
+				"listen":        "127.0.0.1:0",
+				"secret":        "s3cret",
+				"max_body_size": 4096,
+				"ssl.enabled":   false,
+			},
+		}},
+	}
+	bt := newTestBeatWith(t, New, "http://127.0.0.1:1", settings)
+	addr := webhookAddr(bt, "push")
+	p := &fakePipeline{autoACK: true}
+	done := runBeat(bt, p)
+
+	host := <-addr
+	url := "http://" + host + "/alerts"
+	auth := map[string]string{"Authorization": "Bearer s3cret"}
+
+	// Events are queued when the reply is received.
+	status, resp := postAlerts(t, http.DefaultClient, url, exportResponse, auth)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, resp.Events)
+	assert.Equal(t, []interface{}{"a.example.net", "b.example.net"}, publishedQueries(p))
+	assert.Equal(t, "push", p.published()[0].Fields["alphasoc.tenant"])
+
+	status, _ = postAlerts(t, http.DefaultClient, url, exportResponse,
+		map[string]string{"Authorization": "Bearer wrong"})
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = postAlerts(t, http.DefaultClient, url, exportResponse, nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, resp = postAlerts(t, http.DefaultClient, url, "{not json", auth)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.NotEmpty(t, resp.Error)
+
+	// Response without alerts is accepted.
+	for _, body := range []string{`{}`, `{"alerts": null}`} {
+		status, resp = postAlerts(t, http.DefaultClient, url, body, auth)
+		assert.Equal(t, http.StatusOK, status, body)
+		assert.Equal(t, 0, resp.Events, body)
+	}
+
+	status, _ = postAlerts(t, http.DefaultClient, url, string(bytes.Repeat([]byte(" "), 5000)), auth)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	status, _ = postAlerts(t, http.DefaultClient, url, string(bytes.Repeat([]byte(" "), 4096)), auth)
+	assert.Equal(t, http.StatusBadRequest, status, "body of max_body_size is read")
+
+	// Body which cannot be read, here malformed chunk, is a bad request.
+	conn, err := net.Dial("tcp", host)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("POST /alerts HTTP/1.1\r\nHost: localhost\r\nAuthorization: Bearer s3cret\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\nzz\r\n"))
+	require.NoError(t, err)
+	broken, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	broken.Body.Close()
+	conn.Close()
+	assert.Equal(t, http.StatusBadRequest, broken.StatusCode)
+
+	resp2, err := http.Get(url)
+	require.NoError(t, err)
+	resp2.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp2.StatusCode)
+
+	bt.Stop()
+	require.NoError(t, <-done)
+	assert.Len(t, p.published(), 2)
+
+	s := readRegistry(t, bt)
+	assert.Equal(t, int64(3), s.Pages)
+	assert.Equal(t, int64(2), s.Events)
+	assert.Equal(t, time.Date(2021, 4, 7, 9, 56, 37, 0, time.UTC), s.LastAlertTime)
+}
+
+func TestRun_WebhookHMACWithPolling(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 2, x509.ExtKeyUsageServerAuth)
+	ts := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	_, apiURL := newMockAPI(t, mockapi.Page("1-a", false, mockapi.Alert(ts, "polled.example.net", "c2_communication")))
+
+	settings := map[string]interface{}{
+		"registry_file": filepath.Join(t.TempDir(), "checkpoint.yaml"),
+		"inputs": []map[string]interface{}{
+			{"name": "poll", "api_key": "test-key"},
+			{
+				"name": "push",
+				"type": "webhook",
+				"webhook": map[string]interface{}{
+					"listen":          "127.0.0.1:0",
+					"path":            "/hooks/alphasoc",
+					"auth":            "hmac",
+					"secret":          "s3cret",
+					"ssl.certificate": writeTempFile(t, "server.pem", certPEM),
+					"ssl.key":         writeTempFile(t, "server.key", keyPEM),
+				},
+			},
+		},
+	}
+	bt := newTestBeatWith(t, New, apiURL, settings)
+	addr := webhookAddr(bt, "push")
+	p := &fakePipeline{autoACK: true}
+	done := runBeat(bt, p)
+
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(ca.pem))
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	url := "https://" + <-addr + "/hooks/alphasoc"
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(exportResponse))
+	sig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	status, _ := postAlerts(t, client, url, exportResponse, map[string]string{"X-AlphaSOC-Signature": "sha256=00"})
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, resp := postAlerts(t, client, url, exportResponse, map[string]string{"X-AlphaSOC-Signature": sig})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, resp.Events)
+
+	require.Eventually(t, func() bool { return len(p.published()) == 3 },
+		5*time.Second, 5*time.Millisecond)
+	bt.Stop()
+	require.NoError(t, <-done)
+
+	assert.ElementsMatch(t, []interface{}{"a.example.net", "b.example.net", "polled.example.net"},
+		publishedQueries(p))
+}
@@ -21,65 +21,126 @@
 package checkpoint
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
-	"gopkg.in/yaml.v2"
-
 	"github.com/elastic/beats/v7/libbeat/logp"
-	"github.com/elastic/beats/v7/libbeat/paths"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+)
+
+// Metrics of the registry writes of all checkpoints.
+var (
+	registryMetrics = monitoring.Default.NewRegistry("alphasocbeat.registry")
+	writes          = monitoring.NewInt(registryMetrics, "writes")
+	writeErrors     = monitoring.NewInt(registryMetrics, "write_errors")
 )
 
-// Checkpoint persists event log state information to disk.
+// Checkpoint persists event log state information to a Store.
 type Checkpoint struct {
 	wg            sync.WaitGroup // WaitGroup used to wait on the shutdown of the checkpoint worker.
 	done          chan struct{}  // Channel for shutting down the checkpoint worker.
 	once          sync.Once      // Used to guarantee shutdown happens once.
-	file          string         // File where the state is persisted.
-	fileLock      sync.RWMutex   // Lock that protects concurrent reads/writes to file.
-	numUpdates    int            // Number of updates received since last persisting to disk.
+	store         Store          // Store where the state is persisted.
 	maxUpdates    int            // Maximum number of updates to buffer before persisting to disk.
 	flushInterval time.Duration  // Maximum time interval that can pass before persisting to disk.
 
-	lock  sync.RWMutex
-	state string
+	lock       sync.RWMutex
+	states     map[string]State
+	numUpdates int         // Number of updates received since last persisting to disk.
+	closed     bool        // Set by Shutdown, states given afterwards are dropped.
+	err        error       // Error of the last write, nil if it succeeded.
+	onError    func(error) // Called when a write fails.
+
+	notify  chan struct{}   // Signals the worker that the state changed.
+	flushes chan chan error // Flush requests, the worker replies with the write error.
+}
+
+// Version is the version of the registry file format. Version 1 files
+// held a single cursor without the version field.
+const Version = 2
+
+// DefaultCursor is name of the cursor migrated from version 1 registry file.
+const DefaultCursor = "default"
+
+// State is the position in the alerts stream kept by a cursor, together
+// with statistics of the alerts fetched with the cursor.
+type State struct {
+	Follow        string    `yaml:"follow" json:"follow" struct:"follow"`                                      // Follow token of the last fetched alerts.
+	LastAlertTime time.Time `yaml:"last_alert_time,omitempty" json:"last_alert_time" struct:"last_alert_time"` // Time of the newest alert fetched so far.
+	Pages         int64     `yaml:"pages" json:"pages" struct:"pages"`                                         // Number of pages fetched.
+	Events        int64     `yaml:"events" json:"events" struct:"events"`                                      // Number of events published.
+	LastSuccess   time.Time `yaml:"last_success,omitempty" json:"last_success" struct:"last_success"`          // Time of the last successful request.
+
+	// Files holds read offsets of the alert export files of file input,
+	// keyed by file name.
+	Files map[string]FileState `yaml:"files,omitempty" json:"files,omitempty" struct:"files,omitempty"`
+}
+
+// FileState is position in an alert export file.
+type FileState struct {
+	Offset int64  `yaml:"offset" json:"offset" struct:"offset"`                   // Bytes read and published.
+	ID     string `yaml:"id,omitempty" json:"id,omitempty" struct:"id,omitempty"` // Identity of the file, e.g. inode and device.
+}
 
-	save chan string
+// WithFile returns copy of s with the state of the named file set. The
+// files of s are not modified, as they may be shared with the checkpoint.
+func (s State) WithFile(name string, fs FileState) State {
+	files := make(map[string]FileState, len(s.Files)+1)
+	for n, f := range s.Files {
+		files[n] = f
+	}
+	files[name] = fs
+	s.Files = files
+	return s
 }
 
-// PersistedState represents the format of the data persisted to disk.
+// PersistedState represents the format of the data persisted to the store.
 type PersistedState struct {
-	UpdateTime time.Time `yaml:"update_time"`
-	Follow     string    `yaml:"follow"`
+	Version    int              `yaml:"version" json:"version" struct:"version"`
+	UpdateTime time.Time        `yaml:"update_time" json:"update_time" struct:"update_time"`
+	Cursors    map[string]State `yaml:"cursors" json:"cursors" struct:"cursors"`
+}
+
+// persistedStateV1 is the format of version 1 registry file.
+type persistedStateV1 struct {
+	UpdateTime    time.Time `yaml:"update_time"`
+	Follow        string    `yaml:"follow"`
+	LastAlertTime time.Time `yaml:"last_alert_time,omitempty"`
 }
 
-// NewCheckpoint creates and returns a new Checkpoint. This method loads state
-// information from disk if it exists and starts a goroutine for persisting
-// state information to disk. Shutdown should be called when finished to
-// guarantee any in-memory state information is flushed to disk.
+// NewCheckpoint creates and returns a new Checkpoint persisting the state in
+// YAML file, see NewCheckpointWithStore.
+func NewCheckpoint(file string, maxUpdates int, interval time.Duration) (*Checkpoint, error) {
+	store, err := NewFileStore(file, DefaultStoreConfig.Backups)
+	if err != nil {
+		return nil, err
+	}
+	return NewCheckpointWithStore(store, maxUpdates, interval)
+}
+
+// NewCheckpointWithStore creates and returns a new Checkpoint. This method
+// locks the store if it is a Locker, loads state information from the store
+// if it exists and starts a goroutine for persisting state information to
+// the store. Shutdown should be called
+// when finished to guarantee any in-memory state information is flushed to
+// the store, and to close it.
 //
-// file is the name of the file where event log state is persisted as YAML.
 // maxUpdates is the maximum number of updates checkpoint will accept before
-// triggering a flush to disk. interval is maximum amount of time that can
-// pass since the last flush before triggering a flush to disk (minimum value
-// is 1s).
-func NewCheckpoint(file string, maxUpdates int, interval time.Duration) (*Checkpoint, error) {
+// triggering a flush to the store. interval is maximum amount of time that
+// can pass since the last flush before triggering a flush to the store
+// (minimum value is 1s).
+func NewCheckpointWithStore(store Store, maxUpdates int, interval time.Duration) (*Checkpoint, error) {
 	c := &Checkpoint{
 		done:          make(chan struct{}),
-		file:          file,
+		store:         store,
 		maxUpdates:    maxUpdates,
 		flushInterval: interval,
-		save:          make(chan string, 1),
-	}
-
-	err := c.findRegistryFile()
-	if err != nil {
-		return nil, fmt.Errorf("error locating the proper registry file: %+v", err)
+		states:        map[string]State{},
+		notify:        make(chan struct{}, 1),
+		flushes:       make(chan chan error),
 	}
 
 	// Minimum batch size.
@@ -92,19 +153,28 @@ func NewCheckpoint(file string, maxUpdates int, interval time.Duration) (*Checkp
 		c.flushInterval = time.Second
 	}
 
+	if l, ok := store.(Locker); ok {
+		if err := l.Lock(); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
 	// Read existing state information:
-	ps, err := c.read()
+	ps, err := store.Load()
 	if err != nil {
+		store.Close()
 		return nil, err
 	}
 
 	if ps != nil {
-		c.state = ps.Follow
+		c.setStates(ps.Cursors)
 	}
 
-	// Write the state file to verify we have have permissions.
+	// Write the state to verify we have have permissions.
 	err = c.flush()
 	if err != nil {
+		store.Close()
 		return nil, err
 	}
 
@@ -113,83 +183,63 @@ func NewCheckpoint(file string, maxUpdates int, interval time.Duration) (*Checkp
 	return c, nil
 }
 
-// Previously the registry file was written to the root folder. It was fixed on
-// 7.x but not on 6.x. Thus, migration is needed, so users avoid losing state info.
-func (c *Checkpoint) findRegistryFile() error {
-	migratedPath := paths.Resolve(paths.Data, c.file)
-
-	fs, err := os.Stat(c.file)
-	if os.IsNotExist(err) {
-		c.file = migratedPath
-		return nil
-	} else if err != nil {
-		return fmt.Errorf("error accessing previous registry file: %+v", err)
-	}
-
-	// if two files are the same, do not do anything
-	migratedFs, err := os.Stat(migratedPath)
-	if err == nil {
-		if os.SameFile(fs, migratedFs) {
-			return nil
-		}
-	}
-
-	f, err := os.Open(c.file)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	target, err := os.OpenFile(migratedPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.Mode())
+// OpenCheckpoint opens checkpoint persisting the state in YAML file, see
+// OpenCheckpointWithStore.
+func OpenCheckpoint(file string) (*Checkpoint, error) {
+	store, err := NewFileStore(file, DefaultStoreConfig.Backups)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer target.Close()
+	return OpenCheckpointWithStore(store)
+}
 
-	if _, err := io.Copy(target, f); err != nil {
-		return err
+// OpenCheckpointWithStore loads state information from the store like
+// NewCheckpointWithStore, but neither writes the state nor starts the
+// checkpoint worker. It is meant for inspecting and modifying the registry
+// while no beat is using it. Shutdown closes the store.
+func OpenCheckpointWithStore(store Store) (*Checkpoint, error) {
+	c := &Checkpoint{
+		done:   make(chan struct{}),
+		store:  store,
+		states: map[string]State{},
 	}
 
-	err = target.Sync()
+	ps, err := store.Load()
 	if err != nil {
-		return fmt.Errorf("error while syncing new registry file to disk: %+v", err)
+		store.Close()
+		return nil, err
 	}
 
-	c.file = migratedPath
-
-	p := filepath.Dir(migratedPath)
-	pf, err := os.Open(p)
-	if err != nil {
-		return nil
+	if ps != nil {
+		c.setStates(ps.Cursors)
 	}
-	defer pf.Close()
-	pf.Sync()
-
-	return nil
+	return c, nil
 }
 
-// run is worker loop that reads incoming state information from the save
-// channel and persists it when the number of changes reaches maxEvents or
-// the amount of time since the last disk write reaches flushInterval.
+// run is worker loop that persists the in-memory state when the number of
+// changes reaches maxUpdates, the amount of time since the last disk write
+// reaches flushInterval, or when Flush is called. Failed write is retried on
+// the next trigger.
 func (c *Checkpoint) run() {
 	defer c.wg.Done()
 	defer c.persist()
 
 	flushTimer := time.NewTimer(c.flushInterval)
 	defer flushTimer.Stop()
-loop:
 	for {
 		select {
 		case <-c.done:
-			break loop
-		case s := <-c.save:
-			c.lock.Lock()
-			c.state = s
-			c.lock.Unlock()
-			c.numUpdates++
-			if c.numUpdates < c.maxUpdates {
+			return
+		case <-c.notify:
+			c.lock.RLock()
+			n := c.numUpdates
+			c.lock.RUnlock()
+			if n < c.maxUpdates {
 				continue
 			}
+		case reply := <-c.flushes:
+			reply <- c.persist()
+			continue
 		case <-flushTimer.C:
 		}
 
@@ -198,116 +248,252 @@ loop:
 	}
 }
 
-// Shutdown stops the checkpoint worker (which persists any state to disk as
-// it stops). This method blocks until the checkpoint worker shutdowns. Calling
-// this method more once is safe and has no effect.
+// update sets the in-memory state of the cursor.
+func (c *Checkpoint) update(name string, s State) {
+	c.lock.Lock()
+	c.states[name] = s
+	c.numUpdates++
+	c.lock.Unlock()
+}
+
+// setStates replaces the in-memory state of all cursors.
+func (c *Checkpoint) setStates(states map[string]State) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.states = make(map[string]State, len(states))
+	for name, s := range states {
+		c.states[name] = s
+	}
+}
+
+// Shutdown stops the checkpoint worker (which persists any state to the
+// store as it stops) and closes the store. This method blocks until the
+// checkpoint worker shutdowns. Calling this method more once is safe and has
+// no effect.
 func (c *Checkpoint) Shutdown() {
 	c.once.Do(func() {
+		// States accepted before closed is set are written by the final
+		// persist of the worker.
+		c.lock.Lock()
+		c.closed = true
+		c.lock.Unlock()
+
 		close(c.done)
 		c.wg.Wait()
+		if err := c.store.Close(); err != nil {
+			logp.Warn("Failed to close checkpoint store %s: %v", c.store.Location(), err)
+		}
 	})
 }
 
-// State returns the current in-memory event log state. This state information
-// is bootstrapped with any data found on disk at creation time.
-func (c *Checkpoint) State() string {
+// State returns the current in-memory state of the named cursor, which is
+// zero if the cursor does not exist. This state information is bootstrapped
+// with any data found on disk at creation time.
+func (c *Checkpoint) State(name string) State {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
-	return c.state
+	return c.states[name]
 }
 
-// Persist queues the given event log state information to be written to disk.
-func (c *Checkpoint) Persist(follow string) {
-	c.save <- follow
-}
+// Cursors returns names of the existing cursors in sorted order.
+func (c *Checkpoint) Cursors() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
-// persist writes the current state to disk if the in-memory state is dirty.
-func (c *Checkpoint) persist() bool {
-	if c.numUpdates == 0 {
-		return false
+	names := make([]string, 0, len(c.states))
+	for name := range c.states {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	err := c.flush()
-	if err != nil {
-		return false
+// Persist sets the in-memory state of the named cursor, which is written to
+// the store by the checkpoint worker. It does not block while the worker is
+// writing, states given in the meantime are coalesced so only the latest one
+// is written. State given after Shutdown is dropped.
+func (c *Checkpoint) Persist(name string, s State) {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.states[name] = s
+	c.numUpdates++
+	c.lock.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+		// Worker is already notified.
 	}
-
-	logp.Debug("checkpoint", "Checkpoint saved to disk. numUpdates=%d",
-		c.numUpdates)
-	c.numUpdates = 0
-	return true
 }
 
-// flush writes the current state to disk.
-func (c *Checkpoint) flush() error {
-	c.fileLock.Lock()
-	defer c.fileLock.Unlock()
-
-	tempFile := c.file + ".new"
-	file, err := create(tempFile)
-	if os.IsNotExist(err) {
-		// Try to create directory if it does not exist.
-		if createDirErr := c.createDir(); createDirErr == nil {
-			file, err = create(tempFile)
-		}
+// Flush writes the in-memory state to the store and waits until it is
+// written. It returns the write error, or the error of ctx if it is done
+// first. Flush after Shutdown returns the error of the final write.
+func (c *Checkpoint) Flush(ctx context.Context) error {
+	if c.flushes == nil {
+		// Opened without the worker.
+		return c.persist()
 	}
 
-	if err != nil {
-		return fmt.Errorf("Failed to flush state to disk. %v", err)
+	reply := make(chan error, 1)
+	select {
+	case c.flushes <- reply:
+	case <-c.done:
+		c.wg.Wait()
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
-	ps := PersistedState{
-		UpdateTime: time.Now().UTC(),
-		Follow:     c.state,
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	data, err := yaml.Marshal(ps)
-	if err != nil {
-		file.Close()
-		return fmt.Errorf("Failed to flush state to disk. Could not marshal "+
-			"data to YAML. %v", err)
-	}
+// OnError sets function called with the error when writing the state to the
+// store fails. Without it, the error is logged. Failed writes are counted in
+// the alphasocbeat.registry.write_errors metric either way.
+func (c *Checkpoint) OnError(fn func(err error)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	_, err = file.Write(data)
-	if err != nil {
-		file.Close()
-		return fmt.Errorf("Failed to flush state to disk. Could not write to "+
-			"%s. %v", tempFile, err)
-	}
+	c.onError = fn
+}
+
+// Err returns the error of the last write to the store, nil if it succeeded.
+func (c *Checkpoint) Err() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.err
+}
+
+// Cursor returns handle of the named cursor.
+func (c *Checkpoint) Cursor(name string) *Cursor {
+	return &Cursor{checkpoint: c, name: name}
+}
 
-	file.Close()
-	err = os.Rename(tempFile, c.file)
-	return err
+// Cursor is a named position in the alerts stream kept by a Checkpoint.
+type Cursor struct {
+	checkpoint *Checkpoint
+	name       string
 }
 
-// read loads the persisted state from disk. If the file does not exists then
-// the method returns nil and no error.
-func (c *Checkpoint) read() (*PersistedState, error) {
-	c.fileLock.RLock()
-	defer c.fileLock.RUnlock()
+// Name returns name of the cursor.
+func (c *Cursor) Name() string {
+	return c.name
+}
+
+// Location returns location of the registry keeping the cursor.
+func (c *Cursor) Location() string {
+	return c.checkpoint.Location()
+}
+
+// State returns the current in-memory state of the cursor.
+func (c *Cursor) State() State {
+	return c.checkpoint.State(c.name)
+}
+
+// Persist sets the state of the cursor to be written to disk.
+func (c *Cursor) Persist(s State) {
+	c.checkpoint.Persist(c.name, s)
+}
 
-	contents, err := ioutil.ReadFile(c.file)
+// Flush writes the state of the registry keeping the cursor to the store
+// and waits until it is written, see Checkpoint.Flush.
+func (c *Cursor) Flush(ctx context.Context) error {
+	return c.checkpoint.Flush(ctx)
+}
+
+// Location returns location of the registry, e.g. path of the registry file.
+func (c *Checkpoint) Location() string {
+	return c.store.Location()
+}
+
+// Persisted returns the state kept by the store, or nil if nothing is stored
+// yet.
+func (c *Checkpoint) Persisted() (*PersistedState, error) {
+	return c.store.Load()
+}
+
+// Set replaces the in-memory state of the named cursor and writes it to the
+// store right away. It must not be used while the checkpoint worker is running.
+func (c *Checkpoint) Set(name string, s State) error {
+	c.update(name, s)
+	return c.persist()
+}
+
+// persist writes the current state to the store if the in-memory state is
+// dirty. The error is reported and the state is kept dirty if the write fails.
+func (c *Checkpoint) persist() error {
+	c.lock.Lock()
+	n := c.numUpdates
+	if n == 0 {
+		c.lock.Unlock()
+		return nil
+	}
+	ps := c.snapshot()
+	c.numUpdates = 0
+	c.lock.Unlock()
+
+	err := c.store.Save(ps)
+
+	c.lock.Lock()
+	c.err = err
 	if err != nil {
-		if os.IsNotExist(err) {
-			err = nil
-		}
-		return nil, err
+		// Updates received while writing are counted already.
+		c.numUpdates += n
 	}
+	onError := c.onError
+	c.lock.Unlock()
 
-	ps := &PersistedState{}
-	err = yaml.Unmarshal(contents, ps)
 	if err != nil {
-		return nil, err
+		writeErrors.Inc()
+		if onError != nil {
+			onError(err)
+		} else {
+			logp.Err("Failed to write registry %s: %v", c.store.Location(), err)
+		}
+		return err
 	}
 
-	return ps, nil
+	writes.Inc()
+	logp.Debug("checkpoint", "Checkpoint saved to disk. numUpdates=%d", n)
+	return nil
+}
+
+// flush writes the current state to the store.
+func (c *Checkpoint) flush() error {
+	c.lock.RLock()
+	ps := c.snapshot()
+	c.lock.RUnlock()
+
+	return c.store.Save(ps)
+}
+
+// snapshot returns copy of the in-memory state to be written to the store.
+// The lock must be held.
+func (c *Checkpoint) snapshot() PersistedState {
+	ps := PersistedState{
+		Version:    Version,
+		UpdateTime: time.Now().UTC(),
+		Cursors:    make(map[string]State, len(c.states)),
+	}
+	for name, s := range c.states {
+		ps.Cursors[name] = s
+	}
+	return ps
 }
 
-// createDir creates the directory in which the state file will reside if the
-// directory does not already exist.
-func (c *Checkpoint) createDir() error {
-	dir := filepath.Dir(c.file)
-	logp.Info("Creating %s if it does not exist.", dir)
-	return os.MkdirAll(dir, os.FileMode(0750))
+// errNewerVersion reports state written by newer version of the beat.
+func errNewerVersion(version int) error {
+	return fmt.Errorf("registry version %d is newer than supported version %d", version, Version)
 }
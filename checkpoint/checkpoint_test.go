@@ -0,0 +1,368 @@
+package checkpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestOpenCheckpoint(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoint.yaml")
+	data := []byte(`version: 2
+update_time: 2021-05-01T10:00:00Z
+cursors:
+  unit-a:
+    follow: 2-b
+    last_alert_time: 2021-05-01T09:59:00Z
+    pages: 2
+    events: 5
+    last_success: 2021-05-01T09:59:30Z
+`)
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+
+	c, err := OpenCheckpoint(file)
+	require.NoError(t, err)
+	assert.Equal(t, file, c.Location())
+	assert.Equal(t, []string{"unit-a"}, c.Cursors())
+	assert.Equal(t, State{
+		Follow:        "2-b",
+		LastAlertTime: time.Date(2021, 5, 1, 9, 59, 0, 0, time.UTC),
+		Pages:         2,
+		Events:        5,
+		LastSuccess:   time.Date(2021, 5, 1, 9, 59, 30, 0, time.UTC),
+	}, c.State("unit-a"))
+	assert.Equal(t, State{}, c.State("unit-b"))
+
+	// Opening the registry must not touch the file.
+	contents, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, data, contents)
+
+	require.NoError(t, c.Set("unit-b", State{Follow: "3-c"}))
+	ps, err := c.Persisted()
+	require.NoError(t, err)
+	assert.Equal(t, Version, ps.Version)
+	assert.Equal(t, "2-b", ps.Cursors["unit-a"].Follow)
+	assert.Equal(t, State{Follow: "3-c"}, ps.Cursors["unit-b"])
+	assert.True(t, ps.UpdateTime.After(time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)))
+}
+
+func TestOpenCheckpoint_Missing(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "data", "checkpoint.yaml")
+
+	c, err := OpenCheckpoint(file)
+	require.NoError(t, err)
+	assert.Empty(t, c.Cursors())
+
+	ps, err := c.Persisted()
+	require.NoError(t, err)
+	assert.Nil(t, ps)
+
+	// Set creates the missing directory.
+	require.NoError(t, c.Set(DefaultCursor, State{Follow: "1-a"}))
+	ps, err = c.Persisted()
+	require.NoError(t, err)
+	assert.Equal(t, "1-a", ps.Cursors[DefaultCursor].Follow)
+}
+
+func TestOpenCheckpoint_NewerVersion(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoint.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte("version: 3\ncursors: {}\n"), 0600))
+
+	_, err := OpenCheckpoint(file)
+	assert.Error(t, err)
+}
+
+func TestNewCheckpoint_MigratesVersion1(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoint.yaml")
+	data := []byte("update_time: 2021-05-01T10:00:00Z\nfollow: 2-b\nlast_alert_time: 2021-05-01T09:59:00Z\n")
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+
+	c, err := NewCheckpoint(file, 1, time.Minute)
+	require.NoError(t, err)
+	defer c.Shutdown()
+
+	want := State{
+		Follow:        "2-b",
+		LastAlertTime: time.Date(2021, 5, 1, 9, 59, 0, 0, time.UTC),
+	}
+	assert.Equal(t, want, c.State(DefaultCursor))
+
+	// Registry is rewritten in the current version, the original is kept.
+	contents, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	var ps PersistedState
+	require.NoError(t, yaml.Unmarshal(contents, &ps))
+	assert.Equal(t, Version, ps.Version)
+	assert.Equal(t, map[string]State{DefaultCursor: want}, ps.Cursors)
+
+	backup, err := ioutil.ReadFile(file + ".v1")
+	require.NoError(t, err)
+	assert.Equal(t, data, backup)
+
+	// Migrated registry is opened as is.
+	c.Shutdown()
+	c, err = NewCheckpoint(file, 1, time.Minute)
+	require.NoError(t, err)
+	defer c.Shutdown()
+	assert.Equal(t, want, c.State(DefaultCursor))
+}
+
+func TestCheckpoint_PersistCursors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoint.yaml")
+
+	c, err := NewCheckpoint(file, 1, time.Minute)
+	require.NoError(t, err)
+
+	a, b := c.Cursor("unit-a"), c.Cursor("unit-b")
+	assert.Equal(t, "unit-a", a.Name())
+	assert.Equal(t, file, a.Location())
+
+	a.Persist(State{Follow: "1-a", Pages: 1, Events: 3})
+	b.Persist(State{Follow: "1-b", Pages: 1})
+	a.Persist(State{Follow: "2-a", Pages: 2, Events: 4})
+	c.Shutdown()
+
+	c, err = OpenCheckpoint(file)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"unit-a", "unit-b"}, c.Cursors())
+	assert.Equal(t, State{Follow: "2-a", Pages: 2, Events: 4}, c.State("unit-a"))
+	assert.Equal(t, State{Follow: "1-b", Pages: 1}, c.State("unit-b"))
+}
+
+// memStore keeps saved states in memory. Save blocks while the store is
+// held and fails while err is set.
+type memStore struct {
+	mu    sync.Mutex
+	saved []PersistedState
+	held  chan struct{}
+	err   error
+}
+
+func (s *memStore) Load() (*PersistedState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.saved) == 0 {
+		return nil, nil
+	}
+	ps := s.saved[len(s.saved)-1]
+	return &ps, nil
+}
+
+func (s *memStore) Save(ps PersistedState) error {
+	s.mu.Lock()
+	held := s.held
+	s.mu.Unlock()
+	if held != nil {
+		<-held
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.saved = append(s.saved, ps)
+	return nil
+}
+
+func (s *memStore) Location() string { return "memory" }
+
+func (s *memStore) Close() error { return nil }
+
+// hold makes Save block until the returned function is called.
+func (s *memStore) hold() (release func()) {
+	held := make(chan struct{})
+	s.mu.Lock()
+	s.held = held
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		s.held = nil
+		s.mu.Unlock()
+		close(held)
+	}
+}
+
+func (s *memStore) setErr(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func (s *memStore) writes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.saved)
+}
+
+func TestCheckpoint_PersistDoesNotBlock(t *testing.T) {
+	store := &memStore{}
+	c, err := NewCheckpointWithStore(store, 1, time.Minute)
+	require.NoError(t, err)
+	defer c.Shutdown()
+
+	release := store.hold()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 100; i++ {
+			c.Persist(DefaultCursor, State{Follow: fmt.Sprintf("%d-a", i), Pages: int64(i)})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Persist blocked while store was writing")
+	}
+	assert.Equal(t, int64(100), c.State(DefaultCursor).Pages)
+
+	// States given during the write are coalesced into the next one.
+	release()
+	require.NoError(t, c.Flush(context.Background()))
+	ps, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "100-a", ps.Cursors[DefaultCursor].Follow)
+	assert.LessOrEqual(t, store.writes(), 3)
+}
+
+func TestCheckpoint_FlushError(t *testing.T) {
+	store := &memStore{}
+	c, err := NewCheckpointWithStore(store, 10, time.Minute)
+	require.NoError(t, err)
+	defer c.Shutdown()
+
+	var (
+		mu       sync.Mutex
+		reported []error
+	)
+	c.OnError(func(err error) {
+		mu.Lock()
+		reported = append(reported, err)
+		mu.Unlock()
+	})
+
+	failures := writeErrors.Get()
+	errDisk := errors.New("disk full")
+	store.setErr(errDisk)
+	c.Persist(DefaultCursor, State{Follow: "1-a"})
+	assert.ErrorIs(t, c.Flush(context.Background()), errDisk)
+	assert.ErrorIs(t, c.Err(), errDisk)
+	assert.Equal(t, failures+1, writeErrors.Get())
+	mu.Lock()
+	assert.Equal(t, []error{errDisk}, reported)
+	mu.Unlock()
+
+	// Failed state is written by the next flush.
+	store.setErr(nil)
+	require.NoError(t, c.Flush(context.Background()))
+	assert.NoError(t, c.Err())
+	ps, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "1-a", ps.Cursors[DefaultCursor].Follow)
+}
+
+func TestCheckpoint_FlushContext(t *testing.T) {
+	store := &memStore{}
+	c, err := NewCheckpointWithStore(store, 10, time.Minute)
+	require.NoError(t, err)
+
+	release := store.hold()
+	c.Persist(DefaultCursor, State{Follow: "1-a"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, c.Flush(ctx), context.DeadlineExceeded)
+
+	release()
+	c.Shutdown()
+	assert.NoError(t, c.Flush(context.Background()))
+	ps, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "1-a", ps.Cursors[DefaultCursor].Follow)
+}
+
+func TestCheckpoint_Concurrent(t *testing.T) {
+	store := &memStore{}
+	c, err := NewCheckpointWithStore(store, 3, time.Second)
+	require.NoError(t, err)
+
+	const cursors, updates = 8, 200
+	var wg sync.WaitGroup
+	for i := 0; i < cursors; i++ {
+		name := fmt.Sprintf("unit-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 1; j <= updates; j++ {
+				c.Persist(name, State{Follow: fmt.Sprintf("%d-%s", j, name), Pages: int64(j)})
+				if j%50 == 0 {
+					assert.NoError(t, c.Flush(context.Background()))
+				}
+				c.State(name)
+				c.Cursors()
+			}
+		}()
+	}
+	wg.Wait()
+	c.Shutdown()
+
+	// Persist after Shutdown is dropped.
+	c.Persist("unit-0", State{Follow: "late"})
+
+	ps, err := store.Load()
+	require.NoError(t, err)
+	require.Len(t, ps.Cursors, cursors)
+	for name, s := range ps.Cursors {
+		assert.Equal(t, fmt.Sprintf("%d-%s", updates, name), s.Follow)
+		assert.Equal(t, int64(updates), s.Pages)
+	}
+}
+
+func TestCheckpoint_PersistDuringShutdown(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		store := &memStore{}
+		c, err := NewCheckpointWithStore(store, 100, time.Minute)
+		require.NoError(t, err)
+
+		// Cursors keep being persisted until Shutdown returns.
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		for u := 0; u < 4; u++ {
+			name := fmt.Sprintf("unit-%d", u)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := int64(1); ; j++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					c.Persist(name, State{Follow: fmt.Sprintf("%d-%s", j, name), Pages: j})
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		c.Shutdown()
+		close(stop)
+		wg.Wait()
+
+		// The last states accepted are written.
+		ps, err := store.Load()
+		require.NoError(t, err)
+		require.NotNil(t, ps)
+		for _, name := range c.Cursors() {
+			require.Equal(t, c.State(name), ps.Cursors[name], name)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
+	"github.com/elastic/beats/v7/libbeat/esleg/eslegclient"
+)
+
+// ElasticsearchConfig holds settings of the Elasticsearch document store.
+// ID names the beat, it must be unique among beats keeping registries in
+// the index, e.g. name of the deployment, as hosts and data paths of beats
+// on stateless pods are not.
+type ElasticsearchConfig struct {
+	ID       string            `config:"id"`
+	Hosts    []string          `config:"hosts"`
+	Index    string            `config:"index"`
+	Username string            `config:"username"`
+	Password string            `config:"password"`
+	APIKey   string            `config:"api_key"`
+	TLS      *tlscommon.Config `config:"ssl"`
+	Timeout  time.Duration     `config:"timeout" validate:"min=0"`
+}
+
+// DefaultElasticsearchConfig keeps the registry in alphasocbeat-registry index.
+var DefaultElasticsearchConfig = ElasticsearchConfig{
+	Index:   "alphasocbeat-registry",
+	Timeout: 30 * time.Second,
+}
+
+// esStore keeps the state in a document of Elasticsearch index, so it
+// survives losing the local disk, e.g. when a pod is rescheduled. Writes are
+// conditional on the version of the document loaded or written last, so
+// beats configured with the same document do not overwrite each other.
+type esStore struct {
+	conns []*eslegclient.Connection
+	index string
+	id    string
+
+	mu sync.Mutex
+	// exists is set when the document was loaded or written, seqNo and
+	// primaryTerm then hold its version.
+	exists      bool
+	seqNo       int64
+	primaryTerm int64
+}
+
+// esDocument is the registry document. Offsets of the files are kept in an
+// array, so names of the files do not become fields of the index.
+type esDocument struct {
+	Version    int                 `json:"version" struct:"version"`
+	UpdateTime time.Time           `json:"update_time" struct:"update_time"`
+	Cursors    map[string]esCursor `json:"cursors" struct:"cursors"`
+}
+
+// esCursor is state of a cursor in the registry document.
+type esCursor struct {
+	State `struct:",inline"`
+	Files []esFile `json:"files,omitempty" struct:"files,omitempty"`
+}
+
+// esFile is state of a file in the registry document.
+type esFile struct {
+	Name      string `json:"name" struct:"name"`
+	FileState `struct:",inline"`
+}
+
+// esVersion is version of the document returned by Elasticsearch.
+type esVersion struct {
+	SeqNo       int64 `json:"_seq_no"`
+	PrimaryTerm int64 `json:"_primary_term"`
+}
+
+// NewElasticsearchStore returns store keeping the state in document named
+// after ID of c and the registry name. Hosts are tried in order until one of
+// them responds.
+func NewElasticsearchStore(c ElasticsearchConfig, name string) (Store, error) {
+	if len(c.Hosts) == 0 {
+		return nil, errors.New("no elasticsearch hosts configured for the registry")
+	}
+	if c.ID == "" {
+		return nil, errors.New("registry.elasticsearch.id is not set")
+	}
+
+	tls, err := tlscommon.LoadTLSConfig(c.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry.elasticsearch.ssl: %w", err)
+	}
+
+	s := &esStore{index: c.Index, id: c.ID + ":" + name}
+	for _, host := range c.Hosts {
+		conn, err := eslegclient.NewConnection(eslegclient.ConnectionSettings{
+			URL:      host,
+			Username: c.Username,
+			Password: c.Password,
+			APIKey:   c.APIKey,
+			TLS:      tls,
+			Timeout:  c.Timeout,
+		})
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.conns = append(s.conns, conn)
+	}
+	return s, nil
+}
+
+// path returns path of the document.
+func (s *esStore) path() string {
+	return "/" + url.PathEscape(s.index) + "/_doc/" + url.PathEscape(s.id)
+}
+
+// request sends the request to the first host that responds.
+func (s *esStore) request(method string, params map[string]string, body interface{}) (int, []byte, error) {
+	var (
+		status int
+		resp   []byte
+		err    error
+	)
+	for _, conn := range s.conns {
+		status, resp, err = conn.Request(method, s.path(), "", params, body)
+		if status != 0 {
+			break
+		}
+	}
+	return status, resp, err
+}
+
+// Load gets the document.
+func (s *esStore) Load() (*PersistedState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, resp, err := s.request(http.MethodGet, nil, nil)
+	if status == http.StatusNotFound {
+		s.exists = false
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading registry from elasticsearch: %w", err)
+	}
+
+	var doc struct {
+		esVersion
+		Found  bool       `json:"found"`
+		Source esDocument `json:"_source"`
+	}
+	if err := json.Unmarshal(resp, &doc); err != nil {
+		return nil, fmt.Errorf("invalid registry document: %w", err)
+	}
+	if !doc.Found {
+		s.exists = false
+		return nil, nil
+	}
+	if doc.Source.Version > Version {
+		return nil, errNewerVersion(doc.Source.Version)
+	}
+	s.setVersion(doc.esVersion)
+	ps := doc.Source.persistedState()
+	return &ps, nil
+}
+
+// Save indexes the document, waiting until it is visible to Load. It fails
+// if the document was changed since it was loaded or written last.
+func (s *esStore) Save(ps PersistedState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	params := map[string]string{"refresh": "wait_for"}
+	if s.exists {
+		params["if_seq_no"] = strconv.FormatInt(s.seqNo, 10)
+		params["if_primary_term"] = strconv.FormatInt(s.primaryTerm, 10)
+	} else {
+		params["op_type"] = "create"
+	}
+
+	status, resp, err := s.request(http.MethodPut, params, newESDocument(ps))
+	if status == http.StatusConflict {
+		return fmt.Errorf("error saving registry to elasticsearch: document %s was changed "+
+			"by another beat, registry.elasticsearch.id must be unique to this beat", s.id)
+	}
+	if err != nil {
+		return fmt.Errorf("error saving registry to elasticsearch: %w", err)
+	}
+
+	var v esVersion
+	if err := json.Unmarshal(resp, &v); err != nil {
+		return fmt.Errorf("invalid response saving registry to elasticsearch: %w", err)
+	}
+	s.setVersion(v)
+	return nil
+}
+
+// setVersion keeps version of the document loaded or written.
+func (s *esStore) setVersion(v esVersion) {
+	s.exists = true
+	s.seqNo = v.SeqNo
+	s.primaryTerm = v.PrimaryTerm
+}
+
+// newESDocument returns registry document of the state.
+func newESDocument(ps PersistedState) esDocument {
+	doc := esDocument{
+		Version:    ps.Version,
+		UpdateTime: ps.UpdateTime,
+		Cursors:    make(map[string]esCursor, len(ps.Cursors)),
+	}
+	for name, st := range ps.Cursors {
+		c := esCursor{State: st}
+		for file, fs := range st.Files {
+			c.Files = append(c.Files, esFile{Name: file, FileState: fs})
+		}
+		sort.Slice(c.Files, func(i, j int) bool { return c.Files[i].Name < c.Files[j].Name })
+		c.State.Files = nil
+		doc.Cursors[name] = c
+	}
+	return doc
+}
+
+// persistedState returns state kept by the registry document.
+func (doc esDocument) persistedState() PersistedState {
+	ps := PersistedState{
+		Version:    doc.Version,
+		UpdateTime: doc.UpdateTime,
+		Cursors:    make(map[string]State, len(doc.Cursors)),
+	}
+	for name, c := range doc.Cursors {
+		st := c.State
+		st.Files = nil
+		for _, f := range c.Files {
+			if st.Files == nil {
+				st.Files = make(map[string]FileState, len(c.Files))
+			}
+			st.Files[f.Name] = f.FileState
+		}
+		ps.Cursors[name] = st
+	}
+	return ps
+}
+
+// Location returns URL of the document on the first host.
+func (s *esStore) Location() string {
+	return strings.TrimSuffix(s.conns[0].URL, "/") + s.path()
+}
+
+// Close closes the connections.
+func (s *esStore) Close() error {
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
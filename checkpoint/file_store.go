@@ -0,0 +1,400 @@
+package checkpoint
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/paths"
+)
+
+// fileStore keeps the state in a YAML file. The file starts with a comment
+// holding checksum of the rest, so truncated or otherwise corrupted file is
+// detected. Previous files are kept as backups with .1, .2, ... suffixes,
+// the newest valid backup is used when the file is corrupted.
+type fileStore struct {
+	file      string     // File where the state is persisted.
+	backups   int        // Number of previous files to keep.
+	fileLock  sync.Mutex // Lock that protects concurrent reads/writes to file.
+	migrated  bool       // Whether the file was checked for earlier format before saving.
+	corrupted bool       // Whether the state was restored from backup.
+	lock      *registryLock
+}
+
+// checksumPrefix starts the first line of the file holding its checksum.
+const checksumPrefix = "# sha256:"
+
+// NewFileStore returns store keeping the state in YAML file and the given
+// number of its backups. Registry file found in the working directory is
+// moved to the data path. Registry file written in earlier format is read as
+// is and migrated on first save.
+func NewFileStore(file string, backups int) (Store, error) {
+	s := &fileStore{file: file, backups: backups}
+
+	err := s.findRegistryFile()
+	if err != nil {
+		return nil, fmt.Errorf("error locating the proper registry file: %+v", err)
+	}
+
+	return s, nil
+}
+
+// Previously the registry file was written to the root folder. It was fixed on
+// 7.x but not on 6.x. Thus, migration is needed, so users avoid losing state info.
+func (s *fileStore) findRegistryFile() error {
+	migratedPath := paths.Resolve(paths.Data, s.file)
+
+	fs, err := os.Stat(s.file)
+	if os.IsNotExist(err) {
+		s.file = migratedPath
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error accessing previous registry file: %+v", err)
+	}
+
+	// if two files are the same, do not do anything
+	migratedFs, err := os.Stat(migratedPath)
+	if err == nil {
+		if os.SameFile(fs, migratedFs) {
+			return nil
+		}
+	}
+
+	f, err := os.Open(s.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	target, err := os.OpenFile(migratedPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.Mode())
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	if _, err := io.Copy(target, f); err != nil {
+		return err
+	}
+
+	err = target.Sync()
+	if err != nil {
+		return fmt.Errorf("error while syncing new registry file to disk: %+v", err)
+	}
+
+	s.file = migratedPath
+
+	p := filepath.Dir(migratedPath)
+	pf, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer pf.Close()
+	pf.Sync()
+
+	return nil
+}
+
+// Version 1 registry file held a single cursor. It is read as version 2 file
+// with the cursor named DefaultCursor, and before it is overwritten the
+// original file is kept next to it with .v1 suffix.
+func (s *fileStore) migrateRegistryFile() error {
+	contents, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	version, err := fileVersion(contents)
+	if err != nil || version != 1 {
+		// Unreadable file is overwritten as before.
+		return nil
+	}
+
+	fs, err := os.Stat(s.file)
+	if err != nil {
+		return err
+	}
+
+	backup, err := os.OpenFile(s.file+".v1", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.Mode())
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	if _, err := backup.Write(contents); err != nil {
+		return err
+	}
+
+	err = backup.Sync()
+	if err != nil {
+		return fmt.Errorf("error while syncing registry file backup to disk: %+v", err)
+	}
+
+	logp.Info("Migrating registry file %s to version %d, previous version is kept in %s",
+		s.file, Version, backup.Name())
+	return nil
+}
+
+// Save writes the state to the file.
+func (s *fileStore) Save(ps PersistedState) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if !s.migrated {
+		if err := s.migrateRegistryFile(); err != nil {
+			return fmt.Errorf("error migrating the registry file: %+v", err)
+		}
+		s.migrated = true
+	}
+
+	tempFile := s.file + ".new"
+	file, err := create(tempFile)
+	if os.IsNotExist(err) {
+		// Try to create directory if it does not exist.
+		if createDirErr := s.createDir(); createDirErr == nil {
+			file, err = create(tempFile)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to flush state to disk. %v", err)
+	}
+
+	data, err := yaml.Marshal(ps)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to flush state to disk. Could not marshal "+
+			"data to YAML. %v", err)
+	}
+
+	_, err = fmt.Fprintf(file, "%s%x\n%s", checksumPrefix, sha256.Sum256(data), data)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to flush state to disk. Could not write to "+
+			"%s. %v", tempFile, err)
+	}
+
+	file.Close()
+	if err := s.rotate(); err != nil {
+		return fmt.Errorf("Failed to rotate registry file backups. %v", err)
+	}
+	err = os.Rename(tempFile, s.file)
+	return err
+}
+
+// rotate moves the current file to the first backup and shifts the older
+// backups. Corrupted file is kept with .corrupted suffix instead.
+func (s *fileStore) rotate() error {
+	if s.corrupted {
+		s.corrupted = false
+		err := os.Rename(s.file, s.file+".corrupted")
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if s.backups <= 0 {
+		return nil
+	}
+
+	for i := s.backups - 1; i >= 1; i-- {
+		err := os.Rename(s.backupFile(i), s.backupFile(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := os.Rename(s.file, s.backupFile(1))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// backupFile returns path of the i-th newest backup.
+func (s *fileStore) backupFile(i int) string {
+	return fmt.Sprintf("%s.%d", s.file, i)
+}
+
+// Load reads the state from the file. If the file is corrupted or missing
+// while backups exist, the state is read from the newest valid backup. If
+// neither the file nor backups exist then the method returns nil and no
+// error.
+func (s *fileStore) Load() (*PersistedState, error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	ps, err := readRegistryFile(s.file)
+	if err == nil && ps != nil {
+		return ps, nil
+	}
+
+	reason := "is missing"
+	if err != nil {
+		reason = fmt.Sprintf("is corrupted: %v", err)
+	}
+
+	found := false
+	for i := 1; i <= s.backups; i++ {
+		backup := s.backupFile(i)
+		bps, berr := readRegistryFile(backup)
+		if berr != nil {
+			found = true
+			logp.Warn("Registry file backup %s is corrupted: %v", backup, berr)
+			continue
+		}
+		if bps == nil {
+			continue
+		}
+
+		logp.Warn("REGISTRY FILE %s %s. Restored state from backup %s written at %s, "+
+			"alerts fetched after that time will be fetched again.",
+			s.file, reason, backup, bps.UpdateTime.Format(time.RFC3339))
+		s.corrupted = err != nil
+		return bps, nil
+	}
+
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("registry file %s %s, and no valid backup was found", s.file, reason)
+	case found:
+		return nil, fmt.Errorf("registry file %s %s, and its backups are corrupted", s.file, reason)
+	}
+	return nil, nil
+}
+
+// Location returns the path of the registry file.
+func (s *fileStore) Location() string {
+	return s.file
+}
+
+// Lock takes lock of the registry file.
+func (s *fileStore) Lock() error {
+	lock, err := lockRegistry(s.file)
+	if err != nil {
+		return err
+	}
+	s.lock = lock
+	return nil
+}
+
+// Close releases the lock, the file is open only while it is read or written.
+func (s *fileStore) Close() error {
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.unlock()
+	s.lock = nil
+	return err
+}
+
+// createDir creates the directory in which the state file will reside if the
+// directory does not already exist.
+func (s *fileStore) createDir() error {
+	dir := filepath.Dir(s.file)
+	logp.Info("Creating %s if it does not exist.", dir)
+	return os.MkdirAll(dir, os.FileMode(0750))
+}
+
+// readRegistryFile reads and verifies registry file. If the file does not
+// exists then the method returns nil and no error.
+func readRegistryFile(path string) (*PersistedState, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	data, err := verifyChecksum(contents)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// verifyChecksum checks the checksum in the first line of the contents and
+// returns the rest. Contents without checksum, written by earlier versions,
+// are returned as is.
+func verifyChecksum(contents []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(contents)) == 0 {
+		return nil, errors.New("file is empty")
+	}
+	if !bytes.HasPrefix(contents, []byte("#")) {
+		return contents, nil
+	}
+
+	i := bytes.IndexByte(contents, '\n')
+	if i < 0 || !bytes.HasPrefix(contents, []byte(checksumPrefix)) {
+		return nil, errors.New("invalid checksum line")
+	}
+
+	want := string(contents[len(checksumPrefix):i])
+	data := contents[i+1:]
+	if got := fmt.Sprintf("%x", sha256.Sum256(data)); got != want {
+		return nil, fmt.Errorf("checksum mismatch, expected %s, got %s", want, got)
+	}
+	return data, nil
+}
+
+// fileVersion returns format version of the registry file contents.
+func fileVersion(contents []byte) (int, error) {
+	var v struct {
+		Version int `yaml:"version"`
+	}
+	if err := yaml.Unmarshal(contents, &v); err != nil {
+		return 0, err
+	}
+	if v.Version == 0 {
+		return 1, nil
+	}
+	return v.Version, nil
+}
+
+// decode parses registry file contents of any supported version.
+func decode(contents []byte) (*PersistedState, error) {
+	version, err := fileVersion(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case version == 1:
+		v1 := persistedStateV1{}
+		if err := yaml.Unmarshal(contents, &v1); err != nil {
+			return nil, err
+		}
+		ps := &PersistedState{
+			Version:    Version,
+			UpdateTime: v1.UpdateTime,
+			Cursors:    map[string]State{},
+		}
+		if v1.Follow != "" || !v1.LastAlertTime.IsZero() {
+			ps.Cursors[DefaultCursor] = State{
+				Follow:        v1.Follow,
+				LastAlertTime: v1.LastAlertTime,
+			}
+		}
+		return ps, nil
+
+	case version > Version:
+		return nil, errNewerVersion(version)
+	}
+
+	ps := &PersistedState{}
+	if err := yaml.Unmarshal(contents, ps); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
@@ -0,0 +1,141 @@
+package checkpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// saveStates saves each follow token as the only cursor in turn.
+func saveStates(t *testing.T, s Store, follows ...string) {
+	for _, follow := range follows {
+		require.NoError(t, s.Save(PersistedState{
+			Version:    Version,
+			UpdateTime: time.Now().UTC(),
+			Cursors:    map[string]State{DefaultCursor: {Follow: follow}},
+		}))
+	}
+}
+
+// loadFollow returns follow token of the default cursor loaded from s.
+func loadFollow(t *testing.T, s Store) string {
+	ps, err := s.Load()
+	require.NoError(t, err)
+	require.NotNil(t, ps)
+	return ps.Cursors[DefaultCursor].Follow
+}
+
+func TestFileStore_Rotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoint.yaml")
+	s, err := NewFileStore(file, 2)
+	require.NoError(t, err)
+
+	saveStates(t, s, "1-a", "2-b", "3-c", "4-d")
+	assert.Equal(t, "4-d", loadFollow(t, s))
+
+	for i, want := range []string{"3-c", "2-b"} {
+		backup, err := NewFileStore(s.(*fileStore).backupFile(i+1), 0)
+		require.NoError(t, err)
+		assert.Equal(t, want, loadFollow(t, backup))
+	}
+	_, err = os.Stat(file + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileStore_Corrupted(t *testing.T) {
+	tests := map[string]func(data []byte) []byte{
+		"truncated": func(data []byte) []byte {
+			return data[:len(data)-10]
+		},
+		"bit flipped": func(data []byte) []byte {
+			data[len(data)-3] ^= 0x04
+			return data
+		},
+		"bit flipped checksum": func(data []byte) []byte {
+			data[len(checksumPrefix)+1] ^= 0x01
+			return data
+		},
+		"garbage": func(data []byte) []byte {
+			return []byte("\x00\x01{[: not yaml")
+		},
+		"empty": func(data []byte) []byte {
+			return []byte{}
+		},
+	}
+
+	for name, corrupt := range tests {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "checkpoint.yaml")
+			s, err := NewFileStore(file, 2)
+			require.NoError(t, err)
+			saveStates(t, s, "1-a", "2-b")
+
+			data, err := ioutil.ReadFile(file)
+			require.NoError(t, err)
+			data = corrupt(data)
+			require.NoError(t, ioutil.WriteFile(file, data, 0600))
+
+			// Newest valid backup is used.
+			assert.Equal(t, "1-a", loadFollow(t, s))
+
+			// Corrupted file is kept aside and not rotated into backups.
+			saveStates(t, s, "3-c")
+			assert.Equal(t, "3-c", loadFollow(t, s))
+			corrupted, err := ioutil.ReadFile(file + ".corrupted")
+			require.NoError(t, err)
+			assert.Equal(t, data, corrupted)
+			backup, err := NewFileStore(file+".1", 0)
+			require.NoError(t, err)
+			assert.Equal(t, "1-a", loadFollow(t, backup))
+		})
+	}
+}
+
+func TestFileStore_CorruptedBackup(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoint.yaml")
+	s, err := NewFileStore(file, 2)
+	require.NoError(t, err)
+	saveStates(t, s, "1-a", "2-b", "3-c")
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("# sha256:00\nfollow: 3-c\n"), 0600))
+	data, err := ioutil.ReadFile(file + ".1")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(file+".1", data[:len(data)/2], 0600))
+
+	assert.Equal(t, "1-a", loadFollow(t, s))
+
+	// Without valid backup the store fails instead of losing the position.
+	require.NoError(t, os.Remove(file+".2"))
+	_, err = s.Load()
+	assert.Error(t, err)
+}
+
+func TestFileStore_Missing(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoint.yaml")
+	s, err := NewFileStore(file, 2)
+	require.NoError(t, err)
+
+	ps, err := s.Load()
+	require.NoError(t, err)
+	assert.Nil(t, ps)
+
+	// File lost while rotating is restored from backup.
+	saveStates(t, s, "1-a", "2-b")
+	require.NoError(t, os.Remove(file))
+	assert.Equal(t, "1-a", loadFollow(t, s))
+}
+
+func TestFileStore_WithoutChecksum(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoint.yaml")
+	data := []byte("version: 2\ncursors:\n  default:\n    follow: 2-b\n")
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+
+	s, err := NewFileStore(file, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "2-b", loadFollow(t, s))
+}
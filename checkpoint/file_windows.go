@@ -20,6 +20,8 @@ package checkpoint
 import (
 	"os"
 	"syscall"
+
+	"golang.org/x/sys/windows"
 )
 
 const (
@@ -52,3 +54,24 @@ func createWriteThroughFile(path string) (*os.File, error) {
 
 	return os.NewFile(uintptr(h), path), err
 }
+
+// lockRegionOffset is the offset of the locked byte, beyond the contents of
+// the lock file, so the contents can be read while it is locked.
+const lockRegionOffset = 1 << 32
+
+// lockFile takes exclusive lock of the file without waiting.
+func lockFile(f *os.File) error {
+	ol := &windows.Overlapped{OffsetHigh: lockRegionOffset >> 32}
+	err := windows.LockFileEx(windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return errWouldBlock
+	}
+	return err
+}
+
+// unlockFile releases lock taken by lockFile.
+func unlockFile(f *os.File) error {
+	ol := &windows.Overlapped{OffsetHigh: lockRegionOffset >> 32}
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, ol)
+}
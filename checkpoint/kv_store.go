@@ -0,0 +1,221 @@
+package checkpoint
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/paths"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend/memlog"
+)
+
+// Keys of the key-value store. Every cursor is kept under its own key.
+const (
+	kvMetaKey      = "meta"
+	kvCursorPrefix = "cursor::"
+)
+
+// kvMeta is the value of kvMetaKey.
+type kvMeta struct {
+	Version    int    `struct:"version"`
+	UpdateTime string `struct:"update_time"`
+}
+
+// kvCursor is the value of a cursor key. Times are kept as RFC3339 strings,
+// empty for zero time, which does not survive the store encoding. Files are
+// kept as maps of offsets and identities, the store does not decode maps of
+// structs.
+type kvCursor struct {
+	Follow        string            `struct:"follow"`
+	LastAlertTime string            `struct:"last_alert_time"`
+	Pages         int64             `struct:"pages"`
+	Events        int64             `struct:"events"`
+	LastSuccess   string            `struct:"last_success"`
+	FileOffsets   map[string]int64  `struct:"file_offsets"`
+	FileIDs       map[string]string `struct:"file_ids"`
+}
+
+// kvStore keeps the state in the embedded key-value store used by libbeat
+// for the filebeat registry. The store is a directory holding a log of
+// changes and periodic snapshots.
+type kvStore struct {
+	dir      string
+	registry *memlog.Registry
+	store    backend.Store
+	lock     *registryLock
+
+	// mu serializes saving, so removal of deleted cursors does not race.
+	mu sync.Mutex
+}
+
+// NewKVStore returns key-value store kept in the directory named after file
+// without extension, e.g. checkpoint for checkpoint.yaml, in the data path.
+func NewKVStore(file string) (Store, error) {
+	return openKVStore(kvDir(file))
+}
+
+// kvDir returns the directory of key-value store of the registry file.
+func kvDir(file string) string {
+	return paths.Resolve(paths.Data, strings.TrimSuffix(file, filepath.Ext(file)))
+}
+
+// openKVStore opens key-value store in the directory, creating it if it
+// does not exist.
+func openKVStore(dir string) (*kvStore, error) {
+	registry, err := memlog.New(logp.NewLogger("checkpoint"), memlog.Settings{
+		Root:     filepath.Dir(dir),
+		FileMode: 0600,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := registry.Access(filepath.Base(dir))
+	if err != nil {
+		registry.Close()
+		return nil, err
+	}
+
+	return &kvStore{dir: dir, registry: registry, store: store}, nil
+}
+
+// Load reads the meta data and all cursors.
+func (s *kvStore) Load() (*PersistedState, error) {
+	ok, err := s.store.Has(kvMetaKey)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var meta kvMeta
+	if err := s.store.Get(kvMetaKey, &meta); err != nil {
+		return nil, err
+	}
+	if meta.Version > Version {
+		return nil, errNewerVersion(meta.Version)
+	}
+
+	ps := &PersistedState{
+		Version:    meta.Version,
+		UpdateTime: parseTime(meta.UpdateTime),
+		Cursors:    map[string]State{},
+	}
+	err = s.store.Each(func(key string, dec backend.ValueDecoder) (bool, error) {
+		if !strings.HasPrefix(key, kvCursorPrefix) {
+			return true, nil
+		}
+
+		var kc kvCursor
+		if err := dec.Decode(&kc); err != nil {
+			return false, err
+		}
+		st := State{
+			Follow:        kc.Follow,
+			LastAlertTime: parseTime(kc.LastAlertTime),
+			Pages:         kc.Pages,
+			Events:        kc.Events,
+			LastSuccess:   parseTime(kc.LastSuccess),
+		}
+		if len(kc.FileOffsets) > 0 {
+			st.Files = make(map[string]FileState, len(kc.FileOffsets))
+			for name, offset := range kc.FileOffsets {
+				st.Files[name] = FileState{Offset: offset, ID: kc.FileIDs[name]}
+			}
+		}
+		ps.Cursors[strings.TrimPrefix(key, kvCursorPrefix)] = st
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ps, nil
+}
+
+// Save writes the changed cursors and removes deleted ones.
+func (s *kvStore) Save(ps PersistedState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stale []string
+	err := s.store.Each(func(key string, dec backend.ValueDecoder) (bool, error) {
+		name := strings.TrimPrefix(key, kvCursorPrefix)
+		if _, ok := ps.Cursors[name]; !ok && name != key {
+			stale = append(stale, key)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err := s.store.Remove(key); err != nil {
+			return err
+		}
+	}
+
+	for name, st := range ps.Cursors {
+		kc := kvCursor{
+			Follow:        st.Follow,
+			LastAlertTime: formatTime(st.LastAlertTime),
+			Pages:         st.Pages,
+			Events:        st.Events,
+			LastSuccess:   formatTime(st.LastSuccess),
+		}
+		if len(st.Files) > 0 {
+			kc.FileOffsets = make(map[string]int64, len(st.Files))
+			kc.FileIDs = make(map[string]string, len(st.Files))
+			for name, fs := range st.Files {
+				kc.FileOffsets[name] = fs.Offset
+				kc.FileIDs[name] = fs.ID
+			}
+		}
+		if err := s.store.Set(kvCursorPrefix+name, kc); err != nil {
+			return err
+		}
+	}
+
+	return s.store.Set(kvMetaKey, kvMeta{Version: ps.Version, UpdateTime: formatTime(ps.UpdateTime)})
+}
+
+// Location returns the directory of the store.
+func (s *kvStore) Location() string {
+	return s.dir
+}
+
+// Lock takes lock of the store directory.
+func (s *kvStore) Lock() error {
+	lock, err := lockRegistry(s.dir)
+	if err != nil {
+		return err
+	}
+	s.lock = lock
+	return nil
+}
+
+// Close closes the store and its registry, and releases the lock.
+func (s *kvStore) Close() error {
+	err := s.store.Close()
+	s.registry.Close()
+	if s.lock != nil {
+		s.lock.unlock()
+		s.lock = nil
+	}
+	return err
+}
+
+// formatTime formats t for the store, zero time is empty.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// parseTime parses time written by formatTime, invalid time is zero.
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t
+}
@@ -0,0 +1,134 @@
+package checkpoint
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// errWouldBlock is returned by lockFile when the file is locked by another
+// process.
+var errWouldBlock = errors.New("file is locked")
+
+// Locker is implemented by stores that can be locked, so two beats do not
+// share the registry. The lock is released by Close.
+type Locker interface {
+	Lock() error
+}
+
+// LockedError is returned when the registry is locked by another process.
+type LockedError struct {
+	Registry string
+	Owner    LockOwner
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("registry %s is locked by process %d on host %s since %s, "+
+		"stop the other beat using it or configure different registry_file",
+		e.Registry, e.Owner.PID, e.Owner.Hostname, e.Owner.Since.Format(time.RFC3339))
+}
+
+// LockOwner describes process holding the registry lock. It is written to
+// the lock file and cleared when the lock is released, so lock file which is
+// not empty when the lock is taken was left by a crashed process.
+type LockOwner struct {
+	PID      int       `yaml:"pid"`
+	Hostname string    `yaml:"hostname"`
+	Since    time.Time `yaml:"since"`
+}
+
+// registryLock is an advisory OS lock of the lock file next to the registry.
+// The lock is released by OS when the process exits.
+type registryLock struct {
+	file *os.File
+}
+
+// lockRegistry takes the lock of the registry at path, kept in path.lock.
+func lockRegistry(path string) (*registryLock, error) {
+	lockPath := path + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0750); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening registry lock file: %w", err)
+	}
+
+	if err := lockFile(f); err != nil {
+		owner, _ := readLockOwner(f)
+		f.Close()
+		if errors.Is(err, errWouldBlock) {
+			return nil, &LockedError{Registry: path, Owner: owner}
+		}
+		return nil, fmt.Errorf("error locking registry %s: %w", path, err)
+	}
+
+	if owner, err := readLockOwner(f); err != nil || owner.PID != 0 {
+		logp.Warn("Registry %s was not unlocked by process %d on host %s, which "+
+			"locked it at %s and probably crashed, taking over the stale lock",
+			path, owner.PID, owner.Hostname, owner.Since.Format(time.RFC3339))
+	}
+
+	hostname, _ := os.Hostname()
+	owner := LockOwner{PID: os.Getpid(), Hostname: hostname, Since: time.Now().UTC()}
+	if err := writeLockOwner(f, &owner); err != nil {
+		unlockFile(f)
+		f.Close()
+		return nil, fmt.Errorf("error writing registry lock file: %w", err)
+	}
+
+	return &registryLock{file: f}, nil
+}
+
+// unlock clears the owner and releases the lock. The lock file is not
+// removed, another process may be waiting for the lock of the same file.
+func (l *registryLock) unlock() error {
+	err := writeLockOwner(l.file, nil)
+	if uerr := unlockFile(l.file); err == nil {
+		err = uerr
+	}
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readLockOwner reads the owner from the lock file, zero owner means the
+// file is empty.
+func readLockOwner(f *os.File) (LockOwner, error) {
+	var owner LockOwner
+	if _, err := f.Seek(0, 0); err != nil {
+		return owner, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return owner, err
+	}
+	err = yaml.Unmarshal(data, &owner)
+	return owner, err
+}
+
+// writeLockOwner replaces contents of the lock file, nil owner clears it.
+func writeLockOwner(f *os.File, owner *LockOwner) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if owner != nil {
+		data, err := yaml.Marshal(owner)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(data, 0); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
@@ -0,0 +1,71 @@
+package checkpoint
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCheckpoint_Locked(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoint.yaml")
+
+	c, err := NewCheckpoint(file, 1, time.Minute)
+	require.NoError(t, err)
+
+	_, err = NewCheckpoint(file, 1, time.Minute)
+	var lockedErr *LockedError
+	require.True(t, errors.As(err, &lockedErr), "unexpected error: %v", err)
+	assert.Equal(t, os.Getpid(), lockedErr.Owner.PID)
+	assert.Contains(t, err.Error(), "locked by process")
+
+	// Lock is released by Shutdown.
+	c.Shutdown()
+	contents, err := ioutil.ReadFile(file + ".lock")
+	require.NoError(t, err)
+	assert.Empty(t, contents)
+
+	c, err = NewCheckpoint(file, 1, time.Minute)
+	require.NoError(t, err)
+	c.Shutdown()
+}
+
+func TestNewCheckpoint_StaleLock(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoint.yaml")
+	stale := []byte("pid: 999999\nhostname: crashed\nsince: 2021-05-01T10:00:00Z\n")
+	require.NoError(t, ioutil.WriteFile(file+".lock", stale, 0600))
+
+	// Lock file left by crashed process is not locked by OS.
+	c, err := NewCheckpoint(file, 1, time.Minute)
+	require.NoError(t, err)
+	defer c.Shutdown()
+
+	lock, err := os.Open(file + ".lock")
+	require.NoError(t, err)
+	defer lock.Close()
+	owner, err := readLockOwner(lock)
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), owner.PID)
+}
+
+func TestOpenCheckpoint_IgnoresLock(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoint.yaml")
+
+	c, err := NewCheckpoint(file, 1, time.Minute)
+	require.NoError(t, err)
+	defer c.Shutdown()
+	c.Persist(DefaultCursor, State{Follow: "1-a"})
+
+	// Registry can be inspected while the beat is running.
+	require.Eventually(t, func() bool {
+		opened, err := OpenCheckpoint(file)
+		require.NoError(t, err)
+		defer opened.Shutdown()
+		return opened.State(DefaultCursor).Follow == "1-a"
+	}, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,169 @@
+package checkpoint
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/elastic/beats/v7/libbeat/paths"
+)
+
+// Store keeps the persisted state of a checkpoint.
+type Store interface {
+	// Load returns the stored state, or nil if nothing is stored yet.
+	Load() (*PersistedState, error)
+
+	// Save replaces the stored state.
+	Save(ps PersistedState) error
+
+	// Location describes where the state is stored, e.g. path of the file.
+	Location() string
+
+	// Close releases resources held by the store.
+	Close() error
+}
+
+// Store types.
+const (
+	StoreFile          = "file"          // YAML file.
+	StoreKV            = "kv"            // Embedded key-value store.
+	StoreElasticsearch = "elasticsearch" // Elasticsearch document.
+)
+
+// StoreConfig selects the store keeping the registry.
+type StoreConfig struct {
+	Type string `config:"type"`
+
+	// Backups is the number of previous registry files kept by file store.
+	Backups int `config:"backups" validate:"min=0"`
+
+	Elasticsearch ElasticsearchConfig `config:"elasticsearch"`
+}
+
+// DefaultStoreConfig keeps the registry in YAML file.
+var DefaultStoreConfig = StoreConfig{
+	Type:          StoreFile,
+	Backups:       3,
+	Elasticsearch: DefaultElasticsearchConfig,
+}
+
+// Validate checks the store type.
+func (c *StoreConfig) Validate() error {
+	switch c.Type {
+	case StoreFile, StoreKV:
+	case StoreElasticsearch:
+		if len(c.Elasticsearch.Hosts) == 0 {
+			return errors.New("registry.elasticsearch.hosts is not set")
+		}
+		if c.Elasticsearch.ID == "" {
+			return errors.New("registry.elasticsearch.id is not set, set it to a name unique to this beat")
+		}
+	default:
+		return fmt.Errorf("unsupported registry type %q", c.Type)
+	}
+	return nil
+}
+
+// NewStore returns store of the configured type keeping registry with the
+// given name. The name is the path of the file for file and kv stores, and
+// ID of the document, following registry.elasticsearch.id, for elasticsearch
+// store.
+func NewStore(c StoreConfig, name string) (Store, error) {
+	switch c.Type {
+	case StoreFile, "":
+		return NewFileStore(name, c.Backups)
+	case StoreKV:
+		return NewKVStore(name)
+	case StoreElasticsearch:
+		return NewElasticsearchStore(c.Elasticsearch, name)
+	default:
+		return nil, fmt.Errorf("unsupported registry type %q", c.Type)
+	}
+}
+
+// ReadState returns the state kept by the store of the configured type
+// without changing the store: registry file is not migrated to the data
+// path and key-value store is read from a copy, as opening it writes to its
+// directory. It returns nil if nothing is stored yet.
+func ReadState(c StoreConfig, name string) (*PersistedState, error) {
+	switch c.Type {
+	case StoreFile, "":
+		// Registry file in the working directory would be moved to the
+		// data path, so it is the one in use.
+		file := name
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			file = paths.Resolve(paths.Data, name)
+		}
+		return (&fileStore{file: file, backups: c.Backups}).Load()
+	case StoreKV:
+		return readKVState(kvDir(name))
+	case StoreElasticsearch:
+		store, err := NewElasticsearchStore(c.Elasticsearch, name)
+		if err != nil {
+			return nil, err
+		}
+		defer store.Close()
+		return store.Load()
+	default:
+		return nil, fmt.Errorf("unsupported registry type %q", c.Type)
+	}
+}
+
+// readKVState reads state of key-value store in the directory from its copy
+// in a temporary directory.
+func readKVState(dir string) (*PersistedState, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempDir("", "alphasocbeat-registry")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	copyDir := filepath.Join(tmp, filepath.Base(dir))
+	if err := os.Mkdir(copyDir, 0700); err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if err := copyFile(filepath.Join(dir, fi.Name()), filepath.Join(copyDir, fi.Name())); err != nil {
+			return nil, err
+		}
+	}
+
+	store, err := openKVStore(copyDir)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	return store.Load()
+}
+
+// copyFile copies contents of the file src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,298 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeElasticsearch is a local stand-in for Elasticsearch serving documents
+// kept in memory, honouring conditional writes.
+type fakeElasticsearch struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	docs  map[string]json.RawMessage
+	seqNo map[string]int64
+	next  int64
+}
+
+func newFakeElasticsearch(t *testing.T) *fakeElasticsearch {
+	es := &fakeElasticsearch{docs: map[string]json.RawMessage{}, seqNo: map[string]int64{}}
+	es.Server = httptest.NewServer(http.HandlerFunc(es.serve))
+	t.Cleanup(es.Close)
+	return es
+}
+
+func (es *fakeElasticsearch) serve(w http.ResponseWriter, r *http.Request) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	doc, exists := es.docs[r.URL.Path]
+	seqNo := es.seqNo[r.URL.Path]
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"found": false}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"found": true, "_seq_no": seqNo, "_primary_term": 1, "_source": doc,
+		})
+	case http.MethodPut:
+		q := r.URL.Query()
+		if (q.Get("op_type") == "create" && exists) ||
+			(q.Get("if_seq_no") != "" && (!exists || q.Get("if_seq_no") != strconv.FormatInt(seqNo, 10) ||
+				q.Get("if_primary_term") != "1")) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error": {"type": "version_conflict_engine_exception"}}`))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		es.docs[r.URL.Path] = body
+		es.next++
+		es.seqNo[r.URL.Path] = es.next
+		if !exists {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"result": "updated", "_seq_no": es.next, "_primary_term": 1,
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestStores(t *testing.T) {
+	es := newFakeElasticsearch(t)
+
+	esConfig := DefaultElasticsearchConfig
+	esConfig.ID = "beat-1"
+	esConfig.Hosts = []string{es.URL}
+
+	tests := map[string]struct {
+		config   StoreConfig
+		name     string
+		location string
+	}{
+		"file": {
+			config:   StoreConfig{Type: StoreFile},
+			name:     filepath.Join(t.TempDir(), "checkpoint.yaml"),
+			location: "checkpoint.yaml",
+		},
+		"kv": {
+			config:   StoreConfig{Type: StoreKV},
+			name:     filepath.Join(t.TempDir(), "checkpoint.yaml"),
+			location: "checkpoint",
+		},
+		"elasticsearch": {
+			config:   StoreConfig{Type: StoreElasticsearch, Elasticsearch: esConfig},
+			name:     "checkpoint.yaml",
+			location: es.URL + "/alphasocbeat-registry/_doc/beat-1:checkpoint.yaml",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			store, err := NewStore(tt.config, tt.name)
+			require.NoError(t, err)
+			assert.Contains(t, store.Location(), tt.location)
+
+			c, err := NewCheckpointWithStore(store, 1, time.Minute)
+			require.NoError(t, err)
+			want := State{
+				Follow:        "2-a",
+				LastAlertTime: time.Date(2021, 5, 1, 9, 59, 0, 0, time.UTC),
+				Pages:         2,
+				Events:        5,
+				LastSuccess:   time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC),
+				Files:         map[string]FileState{"export-1.ndjson": {Offset: 1024, ID: "1051-64769"}},
+			}
+			c.Persist("unit-a", want)
+			c.Persist("unit-b", State{Follow: "1-b", Pages: 1})
+			c.Shutdown()
+
+			// State is loaded by another instance of the store.
+			store, err = NewStore(tt.config, tt.name)
+			require.NoError(t, err)
+			c, err = OpenCheckpointWithStore(store)
+			require.NoError(t, err)
+			defer c.Shutdown()
+
+			assert.Equal(t, []string{"unit-a", "unit-b"}, c.Cursors())
+			assert.Equal(t, want, c.State("unit-a"))
+			assert.Equal(t, State{Follow: "1-b", Pages: 1}, c.State("unit-b"))
+
+			ps, err := c.Persisted()
+			require.NoError(t, err)
+			assert.Equal(t, Version, ps.Version)
+			assert.False(t, ps.UpdateTime.IsZero())
+		})
+	}
+}
+
+func TestStores_Empty(t *testing.T) {
+	es := newFakeElasticsearch(t)
+	esConfig := DefaultElasticsearchConfig
+	esConfig.ID = "beat-1"
+	esConfig.Hosts = []string{es.URL}
+
+	stores := map[string]StoreConfig{
+		"file":          {Type: StoreFile},
+		"kv":            {Type: StoreKV},
+		"elasticsearch": {Type: StoreElasticsearch, Elasticsearch: esConfig},
+	}
+	for name, config := range stores {
+		t.Run(name, func(t *testing.T) {
+			store, err := NewStore(config, filepath.Join(t.TempDir(), "checkpoint.yaml"))
+			require.NoError(t, err)
+			defer store.Close()
+
+			ps, err := store.Load()
+			require.NoError(t, err)
+			assert.Nil(t, ps)
+		})
+	}
+}
+
+func TestElasticsearchStore_Document(t *testing.T) {
+	es := newFakeElasticsearch(t)
+	config := DefaultElasticsearchConfig
+	config.ID = "beat-1"
+	config.Hosts = []string{es.URL}
+
+	store, err := NewElasticsearchStore(config, "checkpoint.yaml")
+	require.NoError(t, err)
+	defer store.Close()
+	require.NoError(t, store.Save(PersistedState{
+		Version: Version,
+		Cursors: map[string]State{"files": {Files: map[string]FileState{
+			"export-2.ndjson": {Offset: 10},
+			"export-1.ndjson": {Offset: 1024, ID: "1051-64769"},
+		}}},
+	}))
+
+	// Names of the files are values, not fields of the document.
+	var doc struct {
+		Cursors map[string]map[string]interface{} `json:"cursors"`
+	}
+	require.NoError(t, json.Unmarshal(es.docs["/alphasocbeat-registry/_doc/beat-1:checkpoint.yaml"], &doc))
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "export-1.ndjson", "offset": float64(1024), "id": "1051-64769"},
+		map[string]interface{}{"name": "export-2.ndjson", "offset": float64(10)},
+	}, doc.Cursors["files"]["files"])
+}
+
+func TestElasticsearchStore_Conflict(t *testing.T) {
+	es := newFakeElasticsearch(t)
+	config := DefaultElasticsearchConfig
+	config.ID = "beat-1"
+	config.Hosts = []string{es.URL}
+
+	// Two beats configured with the same ID load the same document.
+	a, err := NewElasticsearchStore(config, "checkpoint.yaml")
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := NewElasticsearchStore(config, "checkpoint.yaml")
+	require.NoError(t, err)
+	defer b.Close()
+
+	ps, err := a.Load()
+	require.NoError(t, err)
+	assert.Nil(t, ps)
+	ps, err = b.Load()
+	require.NoError(t, err)
+	assert.Nil(t, ps)
+
+	state := func(follow string) PersistedState {
+		return PersistedState{Version: Version, Cursors: map[string]State{"default": {Follow: follow}}}
+	}
+	require.NoError(t, a.Save(state("1-a")))
+	err = b.Save(state("1-b"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "registry.elasticsearch.id must be unique")
+
+	// The first beat keeps writing, the other does not overwrite it.
+	require.NoError(t, a.Save(state("2-a")))
+	assert.Error(t, b.Save(state("2-b")))
+	ps, err = b.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "2-a", ps.Cursors["default"].Follow)
+
+	// Beat with other ID keeps its own document.
+	config.ID = "beat-2"
+	c, err := NewElasticsearchStore(config, "checkpoint.yaml")
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Save(state("1-c")))
+}
+
+// snapshotDir returns contents of the files in the directory tree.
+func snapshotDir(t *testing.T, dir string) map[string]string {
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		contents, err := ioutil.ReadFile(path)
+		files[path] = string(contents)
+		return err
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func TestReadState(t *testing.T) {
+	for _, typ := range []string{StoreFile, StoreKV} {
+		t.Run(typ, func(t *testing.T) {
+			dir := t.TempDir()
+			name := filepath.Join(dir, "checkpoint.yaml")
+			config := StoreConfig{Type: typ, Backups: 1}
+
+			// Nothing is created when the registry does not exist.
+			ps, err := ReadState(config, name)
+			require.NoError(t, err)
+			assert.Nil(t, ps)
+			assert.Empty(t, snapshotDir(t, dir))
+
+			store, err := NewStore(config, name)
+			require.NoError(t, err)
+			c, err := NewCheckpointWithStore(store, 1, time.Minute)
+			require.NoError(t, err)
+			c.Persist("default", State{Follow: "1-a"})
+			c.Persist("default", State{Follow: "2-a"})
+			c.Shutdown()
+
+			files := snapshotDir(t, dir)
+			ps, err = ReadState(config, name)
+			require.NoError(t, err)
+			require.NotNil(t, ps)
+			assert.Equal(t, "2-a", ps.Cursors["default"].Follow)
+			assert.Equal(t, files, snapshotDir(t, dir))
+		})
+	}
+}
+
+func TestStoreConfig_Validate(t *testing.T) {
+	assert.NoError(t, DefaultStoreConfig.Validate())
+	assert.Error(t, (&StoreConfig{Type: "sql"}).Validate())
+	assert.Error(t, (&StoreConfig{Type: StoreElasticsearch}).Validate())
+
+	es := StoreConfig{Type: StoreElasticsearch, Elasticsearch: DefaultElasticsearchConfig}
+	es.Elasticsearch.Hosts = []string{"http://localhost:9200"}
+	assert.Error(t, es.Validate())
+	es.Elasticsearch.ID = "beat-1"
+	assert.NoError(t, es.Validate())
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+
+	"github.com/alphasoc/alphasocbeat/beater"
+)
+
+// timeLayouts are accepted formats of backfill window bounds.
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+func genBackfillCmd() *cobra.Command {
+	var from, to, registryFile string
+
+	backfillCmd := &cobra.Command{
+		Use:   "backfill",
+		Short: "Fetch historical alerts from a time window",
+		Long: `Fetch alerts from the time window given by --from and --to and publish
+them to the configured output. The registry file of the running beat is not
+used. Position in the window is kept in a separate registry file, so
+interrupted backfill resumes where it stopped when run again. Alerts at or
+after --to are not published.
+
+Backfill cannot share the data path (path.data) with a running beat, which
+holds the alphasocbeat.lock lock in it. Run it with a data path of its own,
+e.g. --path.data data/backfill.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			start, err := parseTime(from)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid --from: %v\n", err)
+				os.Exit(1)
+			}
+
+			end, err := parseTime(to)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid --to: %v\n", err)
+				os.Exit(1)
+			}
+
+			if registryFile == "" {
+				registryFile = fmt.Sprintf("backfill-%d-%d.yaml", start.Unix(), end.Unix())
+			}
+
+			err = instance.Run(settings, beater.NewBackfill(start, end, registryFile))
+			if err != nil {
+				os.Exit(1)
+			}
+		},
+	}
+
+	backfillCmd.Flags().StringVar(&from, "from", "", "Start of the time window (RFC3339 or YYYY-MM-DD)")
+	backfillCmd.Flags().StringVar(&to, "to", "", "End of the time window (RFC3339 or YYYY-MM-DD)")
+	backfillCmd.Flags().StringVar(&registryFile, "registry-file", "",
+		"Registry file keeping position in the window, defaults to backfill-<from>-<to>.yaml in the data path")
+	backfillCmd.MarkFlagRequired("from")
+	backfillCmd.MarkFlagRequired("to")
+
+	return backfillCmd
+}
+
+// parseTime parses time in one of timeLayouts, times without zone are UTC.
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as time, use RFC3339 or YYYY-MM-DD", s)
+}
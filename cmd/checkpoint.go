@@ -0,0 +1,312 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/elastic/beats/v7/libbeat/paths"
+
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+	"github.com/alphasoc/alphasocbeat/config"
+)
+
+// checkpointInfo is the stored cursor as printed in JSON.
+type checkpointInfo struct {
+	Registry      string     `json:"registry"`
+	Version       int        `json:"version,omitempty"`
+	UpdateTime    *time.Time `json:"update_time,omitempty"`
+	Cursor        string     `json:"cursor"`
+	Follow        string     `json:"follow"`
+	LastAlertTime *time.Time `json:"last_alert_time,omitempty"`
+	Pages         int64      `json:"pages"`
+	Events        int64      `json:"events"`
+	LastSuccess   *time.Time `json:"last_success,omitempty"`
+
+	Files map[string]checkpoint.FileState `json:"files,omitempty"`
+}
+
+// checkpointChange computes new state from the stored one.
+type checkpointChange func(s checkpoint.State) (checkpoint.State, error)
+
+func genCheckpointCmd() *cobra.Command {
+	var registryFile, inputName string
+	var asJSON bool
+
+	run := func(change checkpointChange) {
+		if err := runCheckpoint(registryFile, inputName, asJSON, change); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	checkpointCmd := &cobra.Command{
+		Use:   "checkpoint",
+		Short: "Inspect or modify position in the alerts stream",
+		Long: `Inspect or modify the registry file keeping position in the alerts stream.
+The commands refuse to run while a beat using the same data path is running.`,
+	}
+	checkpointCmd.PersistentFlags().StringVar(&registryFile, "registry-file", "",
+		"Registry file to use instead of the registry_file setting")
+	checkpointCmd.PersistentFlags().StringVar(&inputName, "input", "",
+		"Name of the input to use when several inputs are configured, or of the cursor with --registry-file")
+	checkpointCmd.PersistentFlags().BoolVar(&asJSON, "json", false, "Print the checkpoint as JSON")
+
+	checkpointCmd.AddCommand(&cobra.Command{
+		Use:   "show",
+		Short: "Print the stored cursor",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			run(nil)
+		},
+	})
+
+	checkpointCmd.AddCommand(&cobra.Command{
+		Use:   "reset",
+		Short: "Clear the cursor, so alerts are fetched, or export files read, from the beginning",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			run(func(s checkpoint.State) (checkpoint.State, error) {
+				s.Follow = ""
+				s.LastAlertTime = time.Time{}
+				s.Files = nil
+				return s, nil
+			})
+		},
+	})
+
+	checkpointCmd.AddCommand(&cobra.Command{
+		Use:   "set <follow>",
+		Short: "Set the follow token alerts are fetched from",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			run(func(s checkpoint.State) (checkpoint.State, error) {
+				s.Follow = args[0]
+				return s, nil
+			})
+		},
+	})
+
+	checkpointCmd.AddCommand(&cobra.Command{
+		Use:   "rewind <duration>",
+		Short: "Fetch alerts again starting the given duration before the last alert",
+		Long: `Clear the follow token and move the time of the last alert back by the given
+duration (e.g. 90m or 24h), so alerts are fetched again starting from that time.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			run(func(s checkpoint.State) (checkpoint.State, error) {
+				d, err := time.ParseDuration(args[0])
+				if err != nil {
+					return s, fmt.Errorf("invalid duration: %w", err)
+				}
+				return rewind(s, d)
+			})
+		},
+	})
+
+	return checkpointCmd
+}
+
+// rewind returns state fetching alerts from d before the last alert.
+func rewind(s checkpoint.State, d time.Duration) (checkpoint.State, error) {
+	if d <= 0 {
+		return s, fmt.Errorf("rewind duration must be positive, got %s", d)
+	}
+	if s.LastAlertTime.IsZero() {
+		return s, errors.New("time of the last alert is not stored, use set or reset instead")
+	}
+	s.Follow = ""
+	s.LastAlertTime = s.LastAlertTime.Add(-d)
+	return s, nil
+}
+
+// runCheckpoint opens the registry while holding the data path lock, applies
+// change to the stored cursor unless it is nil, and prints the stored cursor.
+func runCheckpoint(registryFile, inputName string, asJSON bool, change checkpointChange) error {
+	b, err := instance.NewInitializedBeat(settings)
+	if err != nil {
+		return fmt.Errorf("error initializing beat: %w", err)
+	}
+
+	sub, err := b.BeatConfig()
+	if err != nil {
+		return err
+	}
+	c := config.DefaultConfig
+	if err := sub.Unpack(&c); err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	cursor := inputName
+	if cursor == "" {
+		cursor = checkpoint.DefaultCursor
+	}
+	if registryFile == "" {
+		registryFile, cursor, err = inputCursor(c, inputName)
+		if err != nil {
+			return err
+		}
+	}
+	if registryFile == "" {
+		return errors.New("registry_file is not set")
+	}
+
+	unlock, err := lockDataPath()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	store, err := checkpoint.NewStore(c.Registry, registryFile)
+	if err != nil {
+		return err
+	}
+	if l, ok := store.(checkpoint.Locker); ok {
+		// Registry may be used by a beat running with another data path.
+		if err := l.Lock(); err != nil {
+			store.Close()
+			return err
+		}
+	}
+	cp, err := checkpoint.OpenCheckpointWithStore(store)
+	if err != nil {
+		return err
+	}
+	defer cp.Shutdown()
+
+	if change != nil {
+		s, err := change(cp.State(cursor))
+		if err != nil {
+			return err
+		}
+		if err := cp.Set(cursor, s); err != nil {
+			return err
+		}
+	}
+
+	ps, err := cp.Persisted()
+	if err != nil {
+		return err
+	}
+	return printCheckpoint(os.Stdout, cp.Location(), cursor, ps, asJSON)
+}
+
+// inputCursor returns registry file and cursor of the named input. Name can
+// be omitted if there is only one input.
+func inputCursor(c config.Config, name string) (file, cursor string, err error) {
+	inputs := c.InputList()
+	if name == "" && len(inputs) == 1 {
+		return inputs[0].RegistryFile, inputs[0].Cursor(), nil
+	}
+
+	var names []string
+	for _, in := range inputs {
+		if in.Name == name {
+			return in.RegistryFile, in.Cursor(), nil
+		}
+		names = append(names, in.Name)
+	}
+
+	if name == "" {
+		return "", "", fmt.Errorf("several inputs configured, select one with --input: %s",
+			strings.Join(names, ", "))
+	}
+	return "", "", fmt.Errorf("input %q is not configured, configured inputs: %s",
+		name, strings.Join(names, ", "))
+}
+
+// lockDataPath takes the lock libbeat holds on the data path while the beat
+// runs, so the registry is not modified under a running beat, and the beat
+// does not start while the registry is modified.
+func lockDataPath() (unlock func(), err error) {
+	dataPath := paths.Resolve(paths.Data, "")
+	if err := os.MkdirAll(dataPath, 0750); err != nil {
+		return nil, err
+	}
+
+	fl := flock.New(paths.Resolve(paths.Data, Name+".lock"))
+	locked, err := fl.TryLock()
+	if err != nil {
+		return nil, fmt.Errorf("unable to lock data path: %w", err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("registry is in use by %s running with data path %s, stop it first",
+			Name, dataPath)
+	}
+
+	return func() {
+		fl.Unlock()
+		os.Remove(fl.Path())
+	}, nil
+}
+
+// printCheckpoint writes the stored cursor as text or JSON, ps is nil if
+// nothing is stored yet.
+func printCheckpoint(w io.Writer, location, cursor string, ps *checkpoint.PersistedState, asJSON bool) error {
+	info := checkpointInfo{Registry: location, Cursor: cursor}
+	if ps != nil {
+		s := ps.Cursors[cursor]
+		info.Version = ps.Version
+		info.UpdateTime = timeOrNil(ps.UpdateTime)
+		info.Follow = s.Follow
+		info.LastAlertTime = timeOrNil(s.LastAlertTime)
+		info.Pages = s.Pages
+		info.Events = s.Events
+		info.LastSuccess = timeOrNil(s.LastSuccess)
+		info.Files = s.Files
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	fmt.Fprintf(w, "Registry:        %s\n", info.Registry)
+	fmt.Fprintf(w, "Update time:     %s\n", formatTime(info.UpdateTime, "(never)"))
+	fmt.Fprintf(w, "Cursor:          %s\n", info.Cursor)
+	fmt.Fprintf(w, "Follow:          %s\n", orDefault(info.Follow, "(none)"))
+	fmt.Fprintf(w, "Last alert time: %s\n", formatTime(info.LastAlertTime, "(unknown)"))
+	fmt.Fprintf(w, "Pages:           %d\n", info.Pages)
+	fmt.Fprintf(w, "Events:          %d\n", info.Events)
+	fmt.Fprintf(w, "Last success:    %s\n", formatTime(info.LastSuccess, "(never)"))
+	names := make([]string, 0, len(info.Files))
+	for name := range info.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "File:            %s at offset %d\n", name, info.Files[name].Offset)
+	}
+	return nil
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+func formatTime(t *time.Time, def string) string {
+	if t == nil {
+		return def
+	}
+	return t.UTC().Format(time.RFC3339)
+}
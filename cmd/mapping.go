@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+
+	"github.com/alphasoc/alphasocbeat/beater"
+)
+
+func genMappingCmd() *cobra.Command {
+	mappingCmd := &cobra.Command{
+		Use:   "mapping",
+		Short: "Describe the fields alerts are mapped to",
+	}
+
+	mappingCmd.AddCommand(&cobra.Command{
+		Use:   "migration-note",
+		Short: "Print migration note from mapping_version 1 to 2",
+		Long: `Print Markdown note describing how to migrate from the custom alphasoc.event.*
+fields of mapping_version 1 to the ECS fields of mapping_version 2, listing
+the custom fields kept as aliases of the ECS fields.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := beater.WriteMappingMigrationNote(os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+		},
+	})
+
+	mappingCmd.AddCommand(&cobra.Command{
+		Use:   "fields",
+		Short: "Print fields.yml additions needed by the mappings setting",
+		Long: `Print fields.yml definitions of the fields the mappings setting maps alert
+attributes to, which are not defined in the index template, e.g. to add them
+to setup.template.append_fields. Mapping to a field which cannot be written
+is reported as an error.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runMappingFields(); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+		},
+	})
+	return mappingCmd
+}
+
+// runMappingFields prints the fields missing for the mappings of the beat
+// config.
+func runMappingFields() error {
+	b, err := instance.NewInitializedBeat(settings)
+	if err != nil {
+		return fmt.Errorf("error initializing beat: %w", err)
+	}
+
+	cfg, err := b.BeatConfig()
+	if err != nil {
+		return err
+	}
+	return beater.WriteMappingFields(os.Stdout, &b.Beat, cfg)
+}
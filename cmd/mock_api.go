@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/alphasoc/alphasocbeat/alphasoc/mockapi"
+)
+
+func genMockAPICmd() *cobra.Command {
+	var (
+		listen, scriptFile, key string
+		pages, pageSize         int
+	)
+
+	mockAPICmd := &cobra.Command{
+		Use:   "mock-api",
+		Short: "Serve mock AlphaSOC alerts API for development",
+		Long: `Serve a local stand-in for the AlphaSOC alerts API. Point api_url of the
+beat to the printed URL to fetch the served alerts.
+
+Without --script the server serves --pages generated pages of alerts. The
+script is a JSON array of responses served one per request, e.g.
+
+  [
+    {"page": {"follow": "1-a", "more": true, "alerts": [...]}},
+    {"status": 429, "header": {"Retry-After": "5"}},
+    {"status": 503},
+    {"body": "{\"follow\": \"truncated"},
+    {"disconnect": true}
+  ]
+
+When the responses are exhausted, empty pages are served.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			script := mockapi.Generate(pages, pageSize)
+			if scriptFile != "" {
+				f, err := os.Open(scriptFile)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error opening script: %v\n", err)
+					os.Exit(1)
+				}
+				script, err = mockapi.LoadScript(f)
+				f.Close()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error reading script %s: %v\n", scriptFile, err)
+					os.Exit(1)
+				}
+			}
+
+			srv := mockapi.New(script...)
+			srv.Key = key
+
+			l, err := net.Listen("tcp", listen)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error listening on %s: %v\n", listen, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Serving %d responses at http://%s, hit CTRL-C to stop\n", len(script), l.Addr())
+
+			if err := http.Serve(l, srv); err != nil {
+				fmt.Fprintf(os.Stderr, "Error serving: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	mockAPICmd.Flags().StringVar(&listen, "listen", "localhost:8080", "Address to listen on")
+	mockAPICmd.Flags().StringVar(&scriptFile, "script", "", "JSON file with the responses to serve")
+	mockAPICmd.Flags().StringVar(&key, "key", "", "API key accepted by the server, any key if empty")
+	mockAPICmd.Flags().IntVar(&pages, "pages", 5, "Number of generated pages")
+	mockAPICmd.Flags().IntVar(&pageSize, "page-size", 10, "Number of alerts in generated page")
+
+	return mockAPICmd
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+
+	"github.com/alphasoc/alphasocbeat/beater"
+)
+
+func genReplayCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "replay <file or directory>...",
+		Short: "Publish alerts of recorded API responses",
+		Long: `Publish alerts of API responses recorded with the record setting to the
+configured output, without contacting the API. Directories are searched for
+recording files, which are replayed in the order they were written. Alerts
+are converted with the current settings, so documents can be reprocessed
+after the mappings changed. The registry is not used.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := instance.Run(settings, beater.NewReplay(args))
+			if err != nil {
+				os.Exit(1)
+			}
+		},
+	}
+}
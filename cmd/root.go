@@ -10,5 +10,17 @@ import (
 // Name of this beat
 var Name = "alphasocbeat"
 
+// settings of the beat instance shared by all subcommands
+var settings = instance.Settings{Name: Name}
+
 // RootCmd to handle beats cli
-var RootCmd = cmd.GenRootCmdWithSettings(beater.New, instance.Settings{Name: Name})
+var RootCmd = cmd.GenRootCmdWithSettings(beater.New, settings)
+
+func init() {
+	RootCmd.AddCommand(genBackfillCmd())
+	RootCmd.AddCommand(genCheckpointCmd())
+	RootCmd.AddCommand(genMappingCmd())
+	RootCmd.AddCommand(genMockAPICmd())
+	RootCmd.AddCommand(genReplayCmd())
+	RootCmd.TestCmd.AddCommand(genTestAPICmd())
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/elastic/beats/v7/libbeat/testing"
+
+	"github.com/alphasoc/alphasocbeat/beater"
+)
+
+func genTestAPICmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "api",
+		Short: "Test " + Name + " can fetch alerts from AlphaSOC API by using the current settings",
+		Long: `Test AlphaSOC API can be reached with the current settings and report each
+step: DNS lookup, connection, TLS handshake, HTTP status, number of alerts and
+rate limit headers. The stored checkpoint is read but never changed.
+
+Exit codes:
+  0  API is reachable and accepts the api key
+  1  invalid configuration
+  2  DNS lookup, connection or TLS handshake failed
+  3  API key rejected
+  4  API returned other error`,
+		Run: func(cmd *cobra.Command, args []string) {
+			b, err := instance.NewInitializedBeat(settings)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error initializing beat: %s\n", err)
+				os.Exit(beater.APITestConfigError)
+			}
+
+			cfg, err := b.BeatConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading beat config: %s\n", err)
+				os.Exit(beater.APITestConfigError)
+			}
+
+			os.Exit(beater.TestAPI(testing.NewConsoleDriver(os.Stdout), cfg))
+		},
+	}
+}
@@ -3,8 +3,393 @@
 
 package config
 
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
+
+	"github.com/alphasoc/alphasocbeat/checkpoint"
+)
+
 type Config struct {
-	RegistryFile string `config:"registry_file"`
-	APIURL       string `config:"api_url"`
-	APIKey       string `config:"api_key"`
+	RegistryFile string     `config:"registry_file"`
+	APIURL       string     `config:"api_url"`
+	APIKey       string     `config:"api_key"`
+	HTTP         HTTPConfig `config:"http"`
+
+	// Registry selects where the registry named by RegistryFile is kept.
+	Registry checkpoint.StoreConfig `config:"registry"`
+
+	// Period is the maximum time between alerts requests when there are
+	// no new alerts.
+	Period time.Duration `config:"period" validate:"min=0"`
+
+	// Inputs lists AlphaSOC accounts to fetch alerts from. If empty, the
+	// account given by APIURL and APIKey is used.
+	Inputs []InputConfig `config:"inputs"`
+
+	// FailOnAuthError stops the beat when API rejects the api key,
+	// instead of retrying with backoff.
+	FailOnAuthError bool `config:"fail_on_auth_error"`
+
+	// InvalidFollow selects what to do when API rejects the stored follow token.
+	InvalidFollow string `config:"invalid_follow"`
+
+	// ShutdownTimeout is how long stopping beat waits for the output to
+	// acknowledge published alerts before persisting the checkpoint.
+	ShutdownTimeout time.Duration `config:"shutdown_timeout" validate:"min=0"`
+
+	// Fingerprint overrides per pipeline the event fields used to compute document ID.
+	Fingerprint map[string][]string `config:"fingerprint"`
+
+	// MappingVersion selects the fields alert events are mapped to,
+	// MappingVersionLegacy or MappingVersionECS.
+	MappingVersion int `config:"mapping_version"`
+
+	// Mappings override per pipeline the fields event and wisdom
+	// attributes of alerts are mapped to.
+	Mappings map[string]MappingConfig `config:"mappings"`
+
+	// PreserveUnmapped keeps event and wisdom attributes of alerts without
+	// mapping under alphasoc.event.extra and alphasoc.wisdom.extra, and the
+	// alert JSON in event.original.
+	PreserveUnmapped bool `config:"preserve_unmapped"`
+
+	// Record selects recording of raw API responses, which can be
+	// replayed later.
+	Record RecordConfig `config:"record"`
+}
+
+// RecordConfig holds settings of recording raw API responses to rotated
+// gzip compressed files.
+type RecordConfig struct {
+	Enabled bool `config:"enabled"`
+
+	// Path is the directory of the recordings, relative to the data path.
+	Path string `config:"path"`
+
+	// RotateEveryKB is the size of uncompressed responses written to a file
+	// before it is rotated. NumberOfFiles is the number of files kept.
+	RotateEveryKB int `config:"rotate_every_kb" validate:"min=1"`
+	NumberOfFiles int `config:"number_of_files" validate:"min=1"`
+}
+
+// InputConfig holds settings of a single AlphaSOC account, or of a
+// directory of its alert exports. Empty APIURL, RegistryFile and Period are
+// taken from the top level settings.
+type InputConfig struct {
+	Name         string        `config:"name"`
+	APIURL       string        `config:"api_url"`
+	APIKey       string        `config:"api_key"`
+	RegistryFile string        `config:"registry_file"`
+	Period       time.Duration `config:"period" validate:"min=0"`
+
+	// Type selects where alerts are read from, InputAPI by default. File
+	// input reads alert export files from the Path directory, checking it
+	// for new data every Period.
+	Type string `config:"type"`
+	Path string `config:"path"`
+
+	// Webhook holds settings of webhook input, which receives alerts
+	// pushed to it instead of fetching them.
+	Webhook WebhookConfig `config:"webhook"`
+
+	// Fields are added to every event of the input, under "fields" unless
+	// FieldsUnderRoot is set.
+	Fields          common.MapStr `config:"fields"`
+	FieldsUnderRoot bool          `config:"fields_under_root"`
+}
+
+// MappingConfig maps event and wisdom attributes of alerts of a pipeline to
+// fields, overriding the built-in mapping. Attributes not mapped by default
+// are added, attributes mapped to empty name are dropped.
+type MappingConfig struct {
+	Event  map[string]string `config:"event"`
+	Wisdom map[string]string `config:"wisdom"`
+}
+
+// WebhookConfig holds settings of the HTTPS server of webhook input. Alerts
+// responses posted to Path are authenticated with Secret as selected by
+// Auth. Plain HTTP is served only if TLS is explicitly disabled.
+type WebhookConfig struct {
+	Listen      string `config:"listen"`
+	Path        string `config:"path"`
+	Auth        string `config:"auth"`
+	Secret      string `config:"secret"`
+	MaxBodySize int64  `config:"max_body_size" validate:"min=0"`
+
+	TLS *tlscommon.ServerConfig `config:"ssl"`
+}
+
+// HTTPConfig holds settings of the HTTP client used to access the API.
+type HTTPConfig struct {
+	// ConnectTimeout limits establishing connection, including TLS
+	// handshake, ResponseTimeout waiting for the response headers after the
+	// request is sent, and RequestTimeout the whole request, from connecting
+	// until the response body is read, see RequestTimeLimit.
+	ConnectTimeout  time.Duration `config:"connect_timeout" validate:"min=0"`
+	ResponseTimeout time.Duration `config:"response_timeout" validate:"min=0"`
+	RequestTimeout  time.Duration `config:"request_timeout" validate:"min=0"`
+
+	// ProxyURL is URL of HTTP or SOCKS5 proxy, credentials can be embedded
+	// in the URL. If empty, proxy is taken from environment variables unless
+	// ProxyDisable is set.
+	ProxyURL     string `config:"proxy_url"`
+	ProxyDisable bool   `config:"proxy_disable"`
+
+	MaxIdleConns        int           `config:"max_idle_connections" validate:"min=0"`
+	MaxIdleConnsPerHost int           `config:"max_idle_connections_per_host" validate:"min=0"`
+	IdleConnTimeout     time.Duration `config:"idle_connection_timeout" validate:"min=0"`
+
+	TLS *tlscommon.Config `config:"ssl"`
+}
+
+// Values of the input type setting.
+const (
+	// InputAPI fetches alerts from AlphaSOC API.
+	InputAPI = "api"
+	// InputFile reads alerts from export files in a directory.
+	InputFile = "file"
+	// InputWebhook receives alerts pushed to its HTTPS server.
+	InputWebhook = "webhook"
+)
+
+// Values of the mapping_version setting.
+const (
+	// MappingVersionLegacy maps protocol data of the events to custom
+	// alphasoc.event.* fields.
+	MappingVersionLegacy = 1
+	// MappingVersionECS maps protocol data to ECS fields, such as
+	// dns.question.name, and turns the legacy fields into aliases of them.
+	MappingVersionECS = 2
+)
+
+// Values of the webhook auth setting.
+const (
+	// WebhookAuthSecret requires the secret as bearer token.
+	WebhookAuthSecret = "secret"
+	// WebhookAuthHMAC requires HMAC-SHA256 signature of the body made with
+	// the secret.
+	WebhookAuthHMAC = "hmac"
+)
+
+// Defaults of the webhook input settings.
+const (
+	DefaultWebhookPath        = "/alerts"
+	DefaultWebhookMaxBodySize = 10 * 1024 * 1024
+)
+
+// Values of the invalid_follow setting.
+const (
+	// InvalidFollowResume fetches alerts newer than the last alert seen.
+	InvalidFollowResume = "resume"
+	// InvalidFollowFail stops the beat.
+	InvalidFollowFail = "fail"
+)
+
+// DefaultConfig is the canonical instantiation of Config.
+var DefaultConfig = Config{
+	Period:          60 * time.Second,
+	InvalidFollow:   InvalidFollowResume,
+	MappingVersion:  MappingVersionLegacy,
+	ShutdownTimeout: 5 * time.Second,
+	Registry:        checkpoint.DefaultStoreConfig,
+	Record: RecordConfig{
+		Path:          "recordings",
+		RotateEveryKB: 10 * 1024,
+		NumberOfFiles: 7,
+	},
+	HTTP: HTTPConfig{
+		ConnectTimeout:      30 * time.Second,
+		ResponseTimeout:     90 * time.Second,
+		MaxIdleConns:        10,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// Validate checks the beat settings.
+func (c *Config) Validate() error {
+	switch c.InvalidFollow {
+	case InvalidFollowResume, InvalidFollowFail:
+	default:
+		return fmt.Errorf("invalid_follow must be %q or %q, got %q",
+			InvalidFollowResume, InvalidFollowFail, c.InvalidFollow)
+	}
+
+	switch c.MappingVersion {
+	case MappingVersionLegacy, MappingVersionECS:
+	default:
+		return fmt.Errorf("mapping_version must be %d or %d, got %d",
+			MappingVersionLegacy, MappingVersionECS, c.MappingVersion)
+	}
+
+	for pipeline, m := range c.Mappings {
+		for section, fields := range map[string]map[string]string{"event": m.Event, "wisdom": m.Wisdom} {
+			for attr, target := range fields {
+				if target != "" && !fieldNameRe.MatchString(target) {
+					return fmt.Errorf("mappings.%s.%s.%s: invalid field name %q, it must consist of "+
+						"dot separated letters, digits, '_', '-' and '@', and not start with '_'",
+						pipeline, section, attr, target)
+				}
+			}
+		}
+	}
+
+	if c.Period <= 0 {
+		return fmt.Errorf("period must be positive, got %s", c.Period)
+	}
+
+	names := map[string]bool{}
+	for _, in := range c.InputList() {
+		if len(c.Inputs) > 0 {
+			if !inputNameRe.MatchString(in.Name) {
+				return fmt.Errorf("input name %q must consist of letters, digits, '-', '_' and '.'", in.Name)
+			}
+			if names[in.Name] {
+				return fmt.Errorf("duplicate input name %q", in.Name)
+			}
+			names[in.Name] = true
+
+			switch in.Type {
+			case InputAPI, "":
+				if in.APIKey == "" {
+					return fmt.Errorf("input %q: api_key is not set", in.Name)
+				}
+			case InputFile:
+				if in.Path == "" {
+					return fmt.Errorf("input %q: path is not set", in.Name)
+				}
+			case InputWebhook:
+				if err := in.Webhook.validate(); err != nil {
+					return fmt.Errorf("input %q: %w", in.Name, err)
+				}
+			default:
+				return fmt.Errorf("input %q: type must be %q, %q or %q, got %q",
+					in.Name, InputAPI, InputFile, InputWebhook, in.Type)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validate checks the webhook settings with defaults applied.
+func (c WebhookConfig) validate() error {
+	if c.Listen == "" {
+		return errors.New("webhook.listen is not set")
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("webhook.path must start with '/', got %q", c.Path)
+	}
+	switch c.Auth {
+	case WebhookAuthSecret, WebhookAuthHMAC:
+	default:
+		return fmt.Errorf("webhook.auth must be %q or %q, got %q",
+			WebhookAuthSecret, WebhookAuthHMAC, c.Auth)
+	}
+	if c.Secret == "" {
+		return errors.New("webhook.secret is not set")
+	}
+	if c.TLS == nil {
+		return errors.New("webhook.ssl is not set, set webhook.ssl.enabled: false to serve plain HTTP")
+	}
+	return nil
+}
+
+// inputNameRe matches valid input names, which are used as cursor names.
+var inputNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// fieldNameRe matches valid names of the fields attributes are mapped to.
+// Names starting with '_' are reserved for metadata fields.
+var fieldNameRe = regexp.MustCompile(`^[A-Za-z0-9@-][A-Za-z0-9_@-]*(\.[A-Za-z0-9_@-]+)*$`)
+
+// InputList returns the inputs with unset settings taken from the top level
+// settings. Without inputs list it returns a single unnamed input with the
+// top level account. Inputs share the top level registry file unless they
+// set their own, each keeps its position in the cursor named after it.
+func (c *Config) InputList() []InputConfig {
+	if len(c.Inputs) == 0 {
+		return []InputConfig{{
+			APIURL:       c.APIURL,
+			APIKey:       c.APIKey,
+			RegistryFile: c.RegistryFile,
+			Period:       c.Period,
+		}}
+	}
+
+	inputs := make([]InputConfig, len(c.Inputs))
+	for i, in := range c.Inputs {
+		if in.APIURL == "" {
+			in.APIURL = c.APIURL
+		}
+		if in.RegistryFile == "" {
+			in.RegistryFile = c.RegistryFile
+		}
+		if in.Period == 0 {
+			in.Period = c.Period
+		}
+		if in.Type == InputWebhook {
+			if in.Webhook.Path == "" {
+				in.Webhook.Path = DefaultWebhookPath
+			}
+			if in.Webhook.Auth == "" {
+				in.Webhook.Auth = WebhookAuthSecret
+			}
+			if in.Webhook.MaxBodySize == 0 {
+				in.Webhook.MaxBodySize = DefaultWebhookMaxBodySize
+			}
+		}
+		inputs[i] = in
+	}
+	return inputs
+}
+
+// Cursor returns name of the registry cursor keeping position of the input.
+// Unnamed input uses the default cursor.
+func (in InputConfig) Cursor() string {
+	if in.Name == "" {
+		return checkpoint.DefaultCursor
+	}
+	return in.Name
+}
+
+// RequestTimeLimit returns time limit of the whole request. Unless
+// RequestTimeout is set, it is ConnectTimeout and twice ResponseTimeout, so
+// reading the body may take as long as waiting for the headers. Requests are
+// not limited when neither RequestTimeout nor ResponseTimeout is set.
+func (c *HTTPConfig) RequestTimeLimit() time.Duration {
+	switch {
+	case c.RequestTimeout > 0:
+		return c.RequestTimeout
+	case c.ResponseTimeout > 0:
+		return c.ConnectTimeout + 2*c.ResponseTimeout
+	}
+	return 0
+}
+
+// Validate checks the HTTP client settings.
+func (c *HTTPConfig) Validate() error {
+	if c.ProxyURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c.ProxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy_url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("unsupported proxy_url scheme %q", u.Scheme)
+	}
+
+	return nil
 }